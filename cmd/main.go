@@ -3,8 +3,11 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/jlammilliman/dbManager/pkg/config"
+	"github.com/jlammilliman/dbManager/pkg/container"
 	"github.com/jlammilliman/dbManager/pkg/logger"
 	"github.com/jlammilliman/dbManager/pkg/seed"
 	"github.com/jlammilliman/dbManager/pkg/setup"
@@ -18,14 +21,33 @@ func main() {
 	config.LogConfig(conf)
 
 	// Configuration options
-	force := false           // -- force 	| -f 	--> Warnings default terminate. This enables a pass-through
-	runSetup := false        // -- setup 	| -up	--> Tells us to generate a DB from the schema provided onto target
-	runGeneration := false   // -- generate 	| -g	--> Tells us to generate a schema from source DB
-	runVerification := false // -- verify	| -v	--> Checks local database schema against source DB
-	runSeed := false         // -- seed		| -s	--> Tells us to generate seed data
+	force := false               // -- force 	| -f 	--> Warnings default terminate. This enables a pass-through
+	runSetup := false            // -- setup 	| -up	--> Tells us to generate a DB from the schema provided onto target
+	atomic := false              // -- atomic	| -at	--> Setup runs in a single transaction, and cleans up after itself on failure
+	runGeneration := false       // -- generate 	| -g	--> Tells us to generate a schema from source DB
+	runVerification := false     // -- verify	| -v	--> Checks local database schema against source DB
+	fromSnapshot := false        // -- snapshot	| -vs	--> Verification checks against the local generation instead of source DB
+	runDataVerification := false // -- verify-data	| -vd	--> Compares row counts and checksums of every table against source DB
+	runSeed := false             // -- seed		| -s	--> Tells us to generate seed data
+	runSubset := false           // -- subset	| -ss	--> Copies a referentially consistent subset of source DB's data into target
+	runMigration := false        // -- migrate	| -m	--> Scripts the changes needed to bring target in line with source DB
+	applyMigration := false      // -- apply	| -a	--> Runs the migration against target once it's written
+	migrationPath := ""          // -- migrate <path>	--> Where to write the migration, defaults to databases/<target>/migration.sql
+	migrateUp := false           // -- migrate-up [version]	| -mu	--> Applies versioned migrations up to version, or the latest
+	migrateVersion := -1         // -1 is latest
+	rollbackSteps := 0           // -- rollback [n]	| -rb	--> Rolls back the last n versioned migrations, default 1
+	newMigration := ""           // -- new-migration <description>	| -nm	--> Creates the next versioned up/down migration
+	containerCommand := ""       // -- container <up|down|status|logs|reset>	| -c	--> Manages the local SQL Server container
+	backupName := ""             // -- backup <name>	| -bk	--> Backs up target once everything else has run
+	restoreName := ""            // -- restore <name>	| -rs	--> Replaces target with a backup before anything else runs
+	listBackups := false         // -- backups	| -bl	--> Lists the backups of target
+
+	var reports setup.VerifyReports // -- report-json <path> | -rj, -- report-junit <path> | -rx --> Write verification findings to file
+
+	exitCode := 0
 
 	// Check for --force flag
-	for _, arg := range os.Args {
+	for i, arg := range os.Args {
 
 		// Force flag enables pass-through on anything that is a warning + break. Displaying the warning, and continuing
 		if arg == "--force" || arg == "-f" {
@@ -40,16 +62,140 @@ func main() {
 			runSetup = true
 			logger.Message("Requested 'Setup'.")
 		}
+		if arg == "--atomic" || arg == "-at" {
+			atomic = true
+		}
 		if arg == "--verify" || arg == "-v" {
 			runVerification = true
 			logger.Message("Requested 'Verification'.")
 		}
+		if arg == "--snapshot" || arg == "-vs" {
+			runVerification = true
+			fromSnapshot = true
+			logger.Message("Requested 'Verification' against local snapshot.")
+		}
+		if arg == "--report-json" || arg == "-rj" {
+			reports.JSONPath = argValue(i)
+			if reports.JSONPath == "" {
+				logger.Error(fmt.Sprintf("'%s' needs a file path.", arg))
+				os.Exit(1)
+			}
+		}
+		if arg == "--report-junit" || arg == "-rx" {
+			reports.JUnitPath = argValue(i)
+			if reports.JUnitPath == "" {
+				logger.Error(fmt.Sprintf("'%s' needs a file path.", arg))
+				os.Exit(1)
+			}
+		}
+		if arg == "--migrate" || arg == "-m" {
+			runMigration = true
+			migrationPath = argValue(i)
+			logger.Message("Requested 'Migration'.")
+		}
+		if arg == "--apply" || arg == "-a" {
+			applyMigration = true
+		}
+		if arg == "--verify-data" || arg == "-vd" {
+			runDataVerification = true
+			logger.Message("Requested 'Data Verification'.")
+		}
+		if arg == "--migrate-up" || arg == "-mu" {
+			migrateUp = true
+			if value := argValue(i); value != "" {
+				version, err := strconv.Atoi(value)
+				if err != nil || version < 0 {
+					logger.Error(fmt.Sprintf("'%s' is not a version.", value))
+					os.Exit(1)
+				}
+				migrateVersion = version
+			}
+			logger.Message("Requested 'Versioned Migration'.")
+		}
+		if arg == "--rollback" || arg == "-rb" {
+			rollbackSteps = 1
+			if value := argValue(i); value != "" {
+				steps, err := strconv.Atoi(value)
+				if err != nil || steps < 1 {
+					logger.Error(fmt.Sprintf("'%s' is not a number of steps.", value))
+					os.Exit(1)
+				}
+				rollbackSteps = steps
+			}
+			logger.Message("Requested 'Rollback'.")
+		}
+		if arg == "--new-migration" || arg == "-nm" {
+			newMigration = argValue(i)
+			if newMigration == "" {
+				logger.Error(fmt.Sprintf("'%s' needs a description.", arg))
+				os.Exit(1)
+			}
+		}
+		if arg == "--container" || arg == "-c" {
+			containerCommand = argValue(i)
+			if containerCommand == "" {
+				logger.Error(fmt.Sprintf("'%s' needs a command: up, down, status, logs, or reset.", arg))
+				os.Exit(1)
+			}
+		}
+		if arg == "--backup" || arg == "-bk" {
+			backupName = argValue(i)
+			if backupName == "" {
+				logger.Error(fmt.Sprintf("'%s' needs a name.", arg))
+				os.Exit(1)
+			}
+			logger.Message("Requested 'Backup'.")
+		}
+		if arg == "--restore" || arg == "-rs" {
+			restoreName = argValue(i)
+			if restoreName == "" {
+				logger.Error(fmt.Sprintf("'%s' needs the name of a backup.", arg))
+				os.Exit(1)
+			}
+			logger.Message("Requested 'Restore'.")
+		}
+		if arg == "--backups" || arg == "-bl" {
+			listBackups = true
+		}
+		if arg == "--subset" || arg == "-ss" {
+			runSubset = true
+			logger.Message("Requested 'Subset'.")
+		}
 		if arg == "--seed" || arg == "-s" {
 			runSeed = true
 			logger.Message("Requested 'Seeding'.")
 		}
 	}
 
+	// Container commands come first, so '-c up --setup' has somewhere to set up on
+	if containerCommand != "" {
+		var err error
+		switch containerCommand {
+		case "up":
+			err = container.Up(conf, false)
+		case "down":
+			err = container.Down(conf)
+		case "status":
+			err = container.Status(conf)
+		case "logs":
+			err = container.Logs(conf)
+		case "reset":
+			// Reset throws the data volume away along with the container
+			if !force {
+				logger.Warning("'reset' deletes the container's data. Rerun with --force to go through with it.")
+				os.Exit(1)
+			}
+			err = container.Reset(conf)
+		default:
+			logger.Error(fmt.Sprintf("'%s' isn't a container command, use up, down, status, logs, or reset.", containerCommand))
+			os.Exit(1)
+		}
+		if err != nil {
+			logger.Error(err.Error())
+			exitCode = 1
+		}
+	}
+
 	if runGeneration {
 		if !conf.HasSource {
 			logger.Error("Cannot run generation without a provided source DB!")
@@ -61,25 +207,111 @@ func main() {
 		}
 	}
 
-	// Always run setup, verification, and then seeding in that order
+	// Always run restore, setup, migration, verification, subset, seeding, and then backup in that order
 	if !conf.HasTarget {
 		logger.Error("Must provide a target database!")
 	} else {
 
+		if restoreName != "" {
+			logger.Info(fmt.Sprintf("Restoring '%s' from '%s'", conf.TargetDB.Name, restoreName))
+			if !setup.Restore(conf, restoreName) {
+				exitCode = 1
+			}
+			logger.Info("Done.")
+		}
+
 		if runSetup {
 			logger.Info(fmt.Sprintf("Running Setup for '%s'", conf.TargetDB.Name))
-			setup.Exec(conf, force)
+			setup.Exec(conf, force, atomic)
+			logger.Info("Done.")
+		}
+
+		if runMigration {
+			logger.Info(fmt.Sprintf("Running Migration for '%s'", conf.TargetDB.Name))
+			if !setup.Migrate(conf, fromSnapshot, migrationPath, applyMigration) {
+				exitCode = 1
+			}
+			logger.Info("Done.")
+		}
+
+		if newMigration != "" {
+			if !setup.NewVersionedMigration(conf, newMigration) {
+				exitCode = 1
+			}
+		}
+
+		if rollbackSteps > 0 {
+			logger.Info(fmt.Sprintf("Rolling back %d migration(s) on '%s'", rollbackSteps, conf.TargetDB.Name))
+			if !setup.RollbackVersions(conf, rollbackSteps) {
+				exitCode = 1
+			}
+			logger.Info("Done.")
+		}
+
+		if migrateUp {
+			logger.Info(fmt.Sprintf("Running Versioned Migrations for '%s'", conf.TargetDB.Name))
+			if !setup.MigrateToVersion(conf, migrateVersion) {
+				exitCode = 1
+			}
 			logger.Info("Done.")
 		}
 
 		if runVerification {
 			logger.Info(fmt.Sprintf("Running Verification for '%s'", conf.TargetDB.Name))
-			logger.Info("Not Implemented.")
+			if !setup.Verify(conf, fromSnapshot, reports) {
+				exitCode = 1 // Lets CI catch a drifted clone
+			}
+			logger.Info("Done.")
+		}
+
+		if runDataVerification {
+			logger.Info(fmt.Sprintf("Running Data Verification for '%s'", conf.TargetDB.Name))
+			if !setup.VerifyData(conf) {
+				exitCode = 1
+			}
+			logger.Info("Done.")
+		}
+
+		if runSubset {
+			if !conf.HasSource {
+				logger.Error("Cannot copy a subset without a provided source DB!")
+				exitCode = 1
+			} else {
+				logger.Info(fmt.Sprintf("Copying a subset of '%s' into '%s'", conf.SourceDB.Name, conf.TargetDB.Name))
+				if !seed.Subset(conf) {
+					exitCode = 1
+				}
+				logger.Info("Done.")
+			}
 		}
 
 		if runSeed {
 			logger.Info(fmt.Sprintf("Running Seed for '%s'", conf.TargetDB.Name))
 			seed.Exec(conf, force)
 		}
+
+		if backupName != "" {
+			logger.Info(fmt.Sprintf("Backing up '%s' as '%s'", conf.TargetDB.Name, backupName))
+			if !setup.Backup(conf, backupName) {
+				exitCode = 1
+			}
+			logger.Info("Done.")
+		}
+
+		if listBackups {
+			if !setup.ListBackups(conf) {
+				exitCode = 1
+			}
+		}
+	}
+
+	os.Exit(exitCode)
+}
+
+// Returns the value following the flag at index i, or "" if there isn't one
+func argValue(i int) string {
+	if i+1 >= len(os.Args) || strings.HasPrefix(os.Args[i+1], "-") {
+		return ""
 	}
+	return os.Args[i+1]
 }
@@ -2,6 +2,10 @@ package config
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -14,13 +18,68 @@ type DB struct {
 	Password string
 }
 
+// The login setup uses to create the database and its users. Also the sa password of the docker container
+type AdminCredentials struct {
+	Username string
+	Password string
+}
+
+// What the admin login falls back to when DB_ADMIN_* isn't set, matching the local docker image
+var DefaultAdminUsername = "sa"
+var DefaultAdminPassword = "Test@123"
+
+// Where the compose file lives unless DOCKER_COMPOSE_FILE says otherwise
+var DefaultComposeFile = "scripts/local-db-setup/docker-compose.yml"
+
+// What the generated compose file runs unless DOCKER_IMAGE / DOCKER_MEMORY_LIMIT say otherwise. SQL Server won't start on less than 2GB
+var DefaultDockerImage = "mcr.microsoft.com/mssql/server:2022-latest"
+var DefaultDockerMemoryLimit = "2g"
+
+// How long to wait on SQL Server to come up unless DB_READY_TIMEOUT says otherwise
+var DefaultReadyTimeout = 2 * time.Minute
+
+// Memory limits are a number with an optional unit, ie: 2g or 2048m
+var memoryLimitPattern = regexp.MustCompile(`^\d+[bkmgBKMG]?$`)
+
+// A login + database user setup creates on the target for applications to connect as
+type AppUser struct {
+	Username    string
+	Password    string
+	Roles       []string // Database roles to add the user to, ie: db_datareader. These have to exist already
+	CustomRoles []string // Roles of our own, created on the target if they aren't there yet
+	Grants      []string // Permissions granted to the user directly, ie: EXECUTE ON SCHEMA::dbo
+}
+
+// A table a data subset starts from
+type SubsetRoot struct {
+	Table string // schema.table, or a bare table name in any schema
+	Limit int    // How many of its rows to start from
+	Where string // Optional filter on those rows, ie: active = 1
+}
+
+// Rows taken from a subset root unless SUBSET_ROOT_<TABLE>_LIMIT says otherwise
+var DefaultSubsetLimit = 50
+
 type Config struct {
 	Environment string
 	DockerContainer string
+	ComposeFile string      // DOCKER_COMPOSE_FILE, defaults to scripts/local-db-setup/docker-compose.yml
+	ComposeService string   // DOCKER_SERVICE_NAME, the compose service running SQL Server. Empty means all of them
+	ContainerRuntime string // DOCKER_RUNTIME: docker, docker-compose, podman, or podman-compose. Empty picks whatever is installed
+	DockerImage string       // DOCKER_IMAGE, the SQL Server image the generated compose file runs
+	DockerVolume string      // DOCKER_VOLUME, where the container keeps its data. Defaults to <container>_data
+	DockerMemoryLimit string // DOCKER_MEMORY_LIMIT, ie: 2g
 
 	SourceDB DB
 	TargetDB DB
 
+	Admin    AdminCredentials
+	AppUsers []AppUser
+
+	ReadyTimeout time.Duration // DB_READY_TIMEOUT, ie: 90s or 5m
+
+	SubsetRoots []SubsetRoot
+
 	HasSource bool
 	HasTarget bool
 	UsingDocker bool
@@ -72,11 +131,36 @@ func loadConfig() (*Config, error) {
 	}
 
 
+	admin, err := loadAdmin(viper.GetString("DOCKER_CONTAINER_NAME") != "")
+	if err != nil {
+		return nil, err
+	}
+
+	appUsers, err := loadAppUsers(targetDB)
+	if err != nil {
+		return nil, err
+	}
+
+	subsetRoots, err := loadSubsetRoots()
+	if err != nil {
+		return nil, err
+	}
+
 	config := &Config{
 		Environment: viper.GetString("ENVIRONMENT"),
 		DockerContainer: viper.GetString("DOCKER_CONTAINER_NAME"),
+		ComposeFile: viper.GetString("DOCKER_COMPOSE_FILE"),
+		ComposeService: viper.GetString("DOCKER_SERVICE_NAME"),
+		ContainerRuntime: viper.GetString("DOCKER_RUNTIME"),
+		DockerImage: viper.GetString("DOCKER_IMAGE"),
+		DockerVolume: viper.GetString("DOCKER_VOLUME"),
+		DockerMemoryLimit: viper.GetString("DOCKER_MEMORY_LIMIT"),
 		SourceDB: *sourceDB,
 		TargetDB: *targetDB,
+		Admin: *admin,
+		AppUsers: appUsers,
+		ReadyTimeout: DefaultReadyTimeout,
+		SubsetRoots: subsetRoots,
 		HasSource: hasSourceDB,
 		HasTarget: hasTargetDB,
 		UsingDocker: false,
@@ -86,15 +170,159 @@ func loadConfig() (*Config, error) {
 		config.UsingDocker = true
 	}
 
+	if config.ComposeFile == "" {
+		config.ComposeFile = DefaultComposeFile
+	}
+
+	if readyTimeout := viper.GetString("DB_READY_TIMEOUT"); readyTimeout != "" {
+		timeout, err := time.ParseDuration(readyTimeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid DB_READY_TIMEOUT '%s', expected something like 90s or 5m", readyTimeout)
+		}
+		config.ReadyTimeout = timeout
+	}
+
+	if config.DockerImage == "" {
+		config.DockerImage = DefaultDockerImage
+	}
+	if config.DockerVolume == "" && config.DockerContainer != "" {
+		config.DockerVolume = config.DockerContainer + "_data"
+	}
+	if config.DockerMemoryLimit == "" {
+		config.DockerMemoryLimit = DefaultDockerMemoryLimit
+	}
+	if !memoryLimitPattern.MatchString(config.DockerMemoryLimit) {
+		return nil, fmt.Errorf("invalid DOCKER_MEMORY_LIMIT '%s', expected something like 2g or 2048m", config.DockerMemoryLimit)
+	}
+
+	switch config.ContainerRuntime {
+	case "", "docker", "docker-compose", "podman", "podman-compose":
+	default:
+		return nil, fmt.Errorf("unknown DOCKER_RUNTIME '%s', expected docker, docker-compose, podman, or podman-compose", config.ContainerRuntime)
+	}
+
 	return config, nil
 }
 
+// Admin credentials are optional, but come as a pair:
+//	DB_ADMIN_USERNAME	--> Defaults to sa
+//	DB_ADMIN_PASSWORD	--> Defaults to Test@123. Also the sa password docker is started with
+func loadAdmin(usingDocker bool) (*AdminCredentials, error) {
+	admin := &AdminCredentials{
+		Username: viper.GetString("DB_ADMIN_USERNAME"),
+		Password: viper.GetString("DB_ADMIN_PASSWORD"),
+	}
+
+	if admin.Username == "" && admin.Password == "" {
+		admin.Username = DefaultAdminUsername
+		admin.Password = DefaultAdminPassword
+		return admin, nil
+	}
+
+	if admin.Username == "" || admin.Password == "" {
+		return nil, fmt.Errorf("DB_ADMIN_USERNAME and DB_ADMIN_PASSWORD must be supplied together")
+	}
+
+	// The container only ever has sa, with whatever password it was started with
+	if usingDocker && admin.Username != "sa" {
+		return nil, fmt.Errorf("docker setup only has the 'sa' login, DB_ADMIN_USERNAME must be 'sa' when DOCKER_CONTAINER_NAME is set")
+	}
+
+	// SQL Server refuses to start with a weak sa password, better to hear about it here than from a dead container
+	if usingDocker && len(admin.Password) < 8 {
+		return nil, fmt.Errorf("DB_ADMIN_PASSWORD must be at least 8 characters for SQL Server to accept it")
+	}
+
+	return admin, nil
+}
+
+// Anything that can't be part of an env key is swapped for an underscore, ie: report-api -> REPORT_API
+var envKeyPattern = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// App users are listed by name in DB_APP_USERS (comma separated), each with its own keys:
+//	DB_APP_USER_<NAME>_PASSWORD	--> Required
+//	DB_APP_USER_<NAME>_ROLES	--> Comma separated database roles, which have to exist on the target
+//	DB_APP_USER_<NAME>_CUSTOM_ROLES	--> Comma separated roles to create if they're missing
+//	DB_APP_USER_<NAME>_GRANTS	--> Semicolon separated permissions, ie: EXECUTE ON SCHEMA::dbo;SELECT ON dbo.Users
+// Without DB_APP_USERS, the target's own credentials get read/write access, like they always have.
+func loadAppUsers(targetDB *DB) ([]AppUser, error) {
+	names := splitList(viper.GetString("DB_APP_USERS"), ",")
+	if len(names) == 0 {
+		if targetDB.Username == "" {
+			return nil, nil
+		}
+		return []AppUser{{
+			Username: targetDB.Username,
+			Password: targetDB.Password,
+			Roles:    []string{"db_datareader", "db_datawriter"},
+		}}, nil
+	}
+
+	var users []AppUser
+	for _, name := range names {
+		prefix := "DB_APP_USER_" + strings.Trim(envKeyPattern.ReplaceAllString(strings.ToUpper(name), "_"), "_")
+		user := AppUser{
+			Username:    name,
+			Password:    viper.GetString(prefix + "_PASSWORD"),
+			Roles:       splitList(viper.GetString(prefix+"_ROLES"), ","),
+			CustomRoles: splitList(viper.GetString(prefix+"_CUSTOM_ROLES"), ","),
+			Grants:      splitList(viper.GetString(prefix+"_GRANTS"), ";"),
+		}
+		if user.Password == "" {
+			return nil, fmt.Errorf("no password supplied for app user '%s' (%s_PASSWORD)", name, prefix)
+		}
+		if len(user.Roles) == 0 && len(user.CustomRoles) == 0 && len(user.Grants) == 0 {
+			return nil, fmt.Errorf("app user '%s' has no roles or grants (%s_ROLES, %s_CUSTOM_ROLES, %s_GRANTS)", name, prefix, prefix, prefix)
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// Subset roots are listed by table in SUBSET_ROOTS (comma separated), each with its own keys:
+//	SUBSET_ROOT_<TABLE>_LIMIT	--> Defaults to 50
+//	SUBSET_ROOT_<TABLE>_WHERE	--> Optional, ie: active = 1
+// <TABLE> is the table as listed, uppercased, with anything else turned into underscores. ie: dbo.Users -> DBO_USERS
+func loadSubsetRoots() ([]SubsetRoot, error) {
+	var roots []SubsetRoot
+	for _, table := range splitList(viper.GetString("SUBSET_ROOTS"), ",") {
+		prefix := "SUBSET_ROOT_" + strings.Trim(envKeyPattern.ReplaceAllString(strings.ToUpper(table), "_"), "_")
+		root := SubsetRoot{
+			Table: table,
+			Limit: DefaultSubsetLimit,
+			Where: strings.TrimSpace(viper.GetString(prefix + "_WHERE")),
+		}
+		if limit := viper.GetString(prefix + "_LIMIT"); limit != "" {
+			value, err := strconv.Atoi(limit)
+			if err != nil || value < 1 {
+				return nil, fmt.Errorf("invalid %s_LIMIT '%s', expected a number of rows", prefix, limit)
+			}
+			root.Limit = value
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// Splits a list from the env, dropping blanks
+func splitList(value, separator string) []string {
+	var items []string
+	for _, item := range strings.Split(value, separator) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func LogConfig(config *Config) {
 	fmt.Println("================================================")
 	fmt.Printf(" ENVIRONMENT    : %s\n", config.Environment)
 
 	if config.UsingDocker {
 		fmt.Printf(" CONTAINER    	: %s\n", config.DockerContainer)
+		fmt.Printf(" COMPOSE FILE 	: %s\n", config.ComposeFile)
+		fmt.Printf(" IMAGE    	: %s (%s)\n", config.DockerImage, config.DockerMemoryLimit)
 	}
 
 	if config.HasSource {
@@ -109,6 +337,16 @@ func LogConfig(config *Config) {
 		fmt.Printf("[TARGET] User	: %s\n", config.TargetDB.Username)
 	}
 
+	fmt.Printf("[ADMIN] User	: %s\n", config.Admin.Username)
+
+	for _, user := range config.AppUsers {
+		fmt.Printf("[APP] User	: %s (%s)\n", user.Username, strings.Join(append(append(append([]string{}, user.Roles...), user.CustomRoles...), user.Grants...), ", "))
+	}
+
+	for _, root := range config.SubsetRoots {
+		fmt.Printf("[SUBSET] Root	: %s (%d rows)\n", root.Table, root.Limit)
+	}
+
 	if !config.HasSource && !config.HasTarget {
 		fmt.Println(" No TARGET or SOURCE DB Provided!")
 	}
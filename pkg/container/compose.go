@@ -0,0 +1,111 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jlammilliman/dbManager/pkg/config"
+	"github.com/jlammilliman/dbManager/pkg/logger"
+)
+
+// The compose file is written from the config, so a fresh checkout only needs its .env.
+// A file we wrote is rewritten every time, keeping it in line with the .env. A file without
+// the marker is someone's own, and is used as is.
+
+var generatedMarker = "# Generated by dbManager from .env, changes here are overwritten. Remove this line to maintain the file by hand."
+
+// The service name used when DOCKER_SERVICE_NAME isn't set
+var defaultServiceName = "db"
+
+// The port SQL Server listens on inside the container
+var containerPort = "1433"
+
+// Writes the compose file unless there is a hand maintained one in its place
+func ensureComposeFile(config *config.Config) error {
+	generated, err := isGenerated(config.ComposeFile)
+	if os.IsNotExist(err) {
+		logger.Debug(fmt.Sprintf("No compose file at '%s', generating one.", config.ComposeFile))
+	} else if err != nil {
+		return fmt.Errorf("failed to read compose file '%s': %v", config.ComposeFile, err)
+	} else if !generated {
+		logger.Debug(fmt.Sprintf("Using hand maintained compose file '%s'.", config.ComposeFile))
+		return nil
+	}
+
+	content, err := composeDefinition(config)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(config.ComposeFile), 0755); err != nil {
+		return fmt.Errorf("failed to create '%s': %v", filepath.Dir(config.ComposeFile), err)
+	}
+	// It holds the sa password, so it's kept to the current user
+	if err := os.WriteFile(config.ComposeFile, []byte(content), 0600); err != nil {
+		return fmt.Errorf("failed to write compose file '%s': %v", config.ComposeFile, err)
+	}
+	return nil
+}
+
+// Checks the first line of a compose file for the marker
+func isGenerated(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return false, scanner.Err()
+	}
+	return strings.TrimSpace(scanner.Text()) == generatedMarker, nil
+}
+
+// Builds the compose definition for the SQL Server container
+func composeDefinition(config *config.Config) (string, error) {
+	if config.DockerContainer == "" {
+		return "", fmt.Errorf("DOCKER_CONTAINER_NAME is needed to generate a compose file")
+	}
+
+	port := config.TargetDB.Port
+	if port == "" {
+		port = containerPort
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return "", fmt.Errorf("DB_TARGET_PORT '%s' isn't a port", port)
+	}
+
+	service := config.ComposeService
+	if service == "" {
+		service = defaultServiceName
+	}
+
+	var lines []string
+	lines = append(lines, generatedMarker)
+	lines = append(lines, "services:")
+	lines = append(lines, fmt.Sprintf("  %s:", yamlString(service)))
+	lines = append(lines, fmt.Sprintf("    image: %s", yamlString(config.DockerImage)))
+	lines = append(lines, fmt.Sprintf("    container_name: %s", yamlString(config.DockerContainer)))
+	lines = append(lines, "    environment:")
+	lines = append(lines, "      ACCEPT_EULA: \"Y\"")
+	lines = append(lines, "      MSSQL_PID: \"Developer\"")
+	lines = append(lines, fmt.Sprintf("      MSSQL_SA_PASSWORD: %s", yamlString(config.Admin.Password)))
+	lines = append(lines, "    ports:")
+	lines = append(lines, fmt.Sprintf("      - %s", yamlString(port+":"+containerPort)))
+	lines = append(lines, fmt.Sprintf("    mem_limit: %s", yamlString(config.DockerMemoryLimit)))
+	lines = append(lines, "    volumes:")
+	lines = append(lines, fmt.Sprintf("      - %s", yamlString(config.DockerVolume+":/var/opt/mssql")))
+	lines = append(lines, "    restart: unless-stopped")
+	lines = append(lines, "volumes:")
+	lines = append(lines, fmt.Sprintf("  %s:", yamlString(config.DockerVolume)))
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// Quotes a value for YAML. Compose also interpolates $, which has to be doubled to stay literal
+func yamlString(value string) string {
+	return strconv.Quote(strings.ReplaceAll(value, "$", "$$"))
+}
@@ -0,0 +1,191 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/jlammilliman/dbManager/pkg/config"
+	"github.com/jlammilliman/dbManager/pkg/logger"
+)
+
+// Lifecycle of the local SQL Server container: up, down, status, logs, and reset.
+// Everything goes through the compose file (see compose.go), so it works the same with docker compose v2, docker-compose, and podman.
+
+// How to talk to a container runtime
+type Runtime struct {
+	Name    string   // docker or podman, for inspecting containers
+	Compose []string // The command compose subcommands hang off of, ie: docker compose, or docker-compose
+}
+
+// The order runtimes are tried in when DOCKER_RUNTIME isn't set
+var runtimes = map[string]Runtime{
+	"docker":         {Name: "docker", Compose: []string{"docker", "compose"}},
+	"docker-compose": {Name: "docker", Compose: []string{"docker-compose"}},
+	"podman":         {Name: "podman", Compose: []string{"podman", "compose"}},
+	"podman-compose": {Name: "podman", Compose: []string{"podman-compose"}},
+}
+var runtimeOrder = []string{"docker", "docker-compose", "podman", "podman-compose"}
+
+// Lines of log shown by Logs
+var logTail = "200"
+
+// Finds the runtime to use: the configured one, or the first that is actually installed
+func GetRuntime(config *config.Config) (*Runtime, error) {
+	if config.ContainerRuntime != "" {
+		runtime := runtimes[config.ContainerRuntime]
+		if !runtime.available() {
+			return nil, fmt.Errorf("DOCKER_RUNTIME is '%s', but '%s' isn't working on this machine", config.ContainerRuntime, strings.Join(runtime.Compose, " "))
+		}
+		return &runtime, nil
+	}
+
+	for _, name := range runtimeOrder {
+		runtime := runtimes[name]
+		if runtime.available() {
+			logger.Debug(fmt.Sprintf("Using '%s' to manage containers.", strings.Join(runtime.Compose, " ")))
+			return &runtime, nil
+		}
+	}
+	return nil, fmt.Errorf("no container runtime found, install docker or podman (with compose)")
+}
+
+// Compose plugins are subcommands, so the binary alone existing isn't enough
+func (runtime Runtime) available() bool {
+	if _, err := exec.LookPath(runtime.Compose[0]); err != nil {
+		return false
+	}
+	args := append(append([]string{}, runtime.Compose[1:]...), "version")
+	return exec.Command(runtime.Compose[0], args...).Run() == nil
+}
+
+// Builds a compose command against the configured compose file
+func (runtime Runtime) compose(config *config.Config, args ...string) *exec.Cmd {
+	fullArgs := append(append([]string{}, runtime.Compose[1:]...), "-f", config.ComposeFile)
+	fullArgs = append(fullArgs, args...)
+
+	cmd := exec.Command(runtime.Compose[0], fullArgs...)
+	// The compose file reads the sa password from the environment, so it always matches what we connect with
+	cmd.Env = append(os.Environ(), "MSSQL_SA_PASSWORD="+config.Admin.Password, "SA_PASSWORD="+config.Admin.Password)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// Appends the configured service, if there is one
+func withService(config *config.Config, args ...string) []string {
+	if config.ComposeService != "" {
+		args = append(args, config.ComposeService)
+	}
+	return args
+}
+
+// Checks to see if the configured container is running on the host machine
+func IsRunning(config *config.Config) bool {
+	runtime, err := GetRuntime(config)
+	if err != nil {
+		return false
+	}
+	return runtime.isRunning(config.DockerContainer)
+}
+
+func (runtime Runtime) isRunning(containerName string) bool {
+	output, err := exec.Command(runtime.Name, "inspect", "-f", "{{.State.Running}}", containerName).Output()
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(output)) == "true"
+}
+
+// Starts the container, optionally recreating it from scratch
+func Up(config *config.Config, recreate bool) error {
+	runtime, err := GetRuntime(config)
+	if err != nil {
+		return err
+	}
+	if err := ensureComposeFile(config); err != nil {
+		return err
+	}
+
+	args := []string{"up", "-d"}
+	if recreate {
+		args = append(args, "--force-recreate")
+	}
+	if err := runtime.compose(config, withService(config, args...)...).Run(); err != nil {
+		return fmt.Errorf("failed to start container: %v", err)
+	}
+	return nil
+}
+
+// Stops and removes the container. Its data volume is kept
+func Down(config *config.Config) error {
+	runtime, err := GetRuntime(config)
+	if err != nil {
+		return err
+	}
+	if err := ensureComposeFile(config); err != nil {
+		return err
+	}
+
+	if err := runtime.compose(config, "down").Run(); err != nil {
+		return fmt.Errorf("failed to stop container: %v", err)
+	}
+	return nil
+}
+
+// Reports whether the container is running, along with what compose knows about it
+func Status(config *config.Config) error {
+	runtime, err := GetRuntime(config)
+	if err != nil {
+		return err
+	}
+
+	if config.DockerContainer != "" {
+		if runtime.isRunning(config.DockerContainer) {
+			logger.Info(fmt.Sprintf("Container '%s' is running.", config.DockerContainer))
+		} else {
+			logger.Info(fmt.Sprintf("Container '%s' is not running.", config.DockerContainer))
+		}
+	}
+
+	if err := ensureComposeFile(config); err != nil {
+		return err
+	}
+	if err := runtime.compose(config, withService(config, "ps")...).Run(); err != nil {
+		return fmt.Errorf("failed to get container status: %v", err)
+	}
+	return nil
+}
+
+// Prints the most recent logs of the container
+func Logs(config *config.Config) error {
+	runtime, err := GetRuntime(config)
+	if err != nil {
+		return err
+	}
+	if err := ensureComposeFile(config); err != nil {
+		return err
+	}
+
+	if err := runtime.compose(config, withService(config, "logs", "--tail", logTail)...).Run(); err != nil {
+		return fmt.Errorf("failed to get container logs: %v", err)
+	}
+	return nil
+}
+
+// Throws the container and its data away, and starts a fresh one
+func Reset(config *config.Config) error {
+	runtime, err := GetRuntime(config)
+	if err != nil {
+		return err
+	}
+	if err := ensureComposeFile(config); err != nil {
+		return err
+	}
+
+	if err := runtime.compose(config, "down", "--volumes").Run(); err != nil {
+		return fmt.Errorf("failed to remove container: %v", err)
+	}
+	return Up(config, true)
+}
@@ -0,0 +1,161 @@
+package readiness
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/jlammilliman/dbManager/pkg/config"
+	"github.com/jlammilliman/dbManager/pkg/logger"
+)
+
+// Waiting on SQL Server: first for the server to take logins, then for a database to be ONLINE and let us in.
+// Checks are retried with a growing delay until they pass, the timeout runs out, or someone hits Ctrl+C.
+
+// Delay before the first retry, doubled after each one up to maxDelay
+var initialDelay = 500 * time.Millisecond
+var maxDelay = 10 * time.Second
+
+// How long a single attempt gets before it counts as failed
+var attemptTimeout = 15 * time.Second
+
+// How often we let people know we're still waiting
+var progressInterval = 5 * time.Second
+
+// SQL Server's "Login failed for user" error
+const loginFailedError = 18456
+
+// A check that can never pass by waiting, ie: the database doesn't exist
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+
+// Checks once whether the server takes logins, without any waiting
+func IsServerUp(database config.DB) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), attemptTimeout)
+	defer cancel()
+	return checkServer(ctx, database) == nil
+}
+
+// Waits for the server to take logins with the database's credentials
+func WaitForServer(timeout time.Duration, database config.DB) error {
+	return wait(timeout, fmt.Sprintf("SQL Server at '%s:%s'", database.Host, database.Port), func(ctx context.Context) error {
+		return checkServer(ctx, database)
+	})
+}
+
+// Waits for the server, then for the database to be ONLINE and accepting logins
+func WaitForDatabase(timeout time.Duration, database config.DB) error {
+	return wait(timeout, fmt.Sprintf("database '%s' at '%s:%s'", database.Name, database.Host, database.Port), func(ctx context.Context) error {
+		if err := checkServer(ctx, database); err != nil {
+			return err
+		}
+		return checkDatabase(ctx, database)
+	})
+}
+
+// Retries check with backoff. Stops early on a permanent error, or on Ctrl+C
+func wait(timeout time.Duration, what string, check func(ctx context.Context) error) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	var lastProgress time.Time
+	delay := initialDelay
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancelAttempt := context.WithTimeout(ctx, attemptTimeout)
+		err := check(attemptCtx)
+		cancelAttempt()
+
+		if err == nil {
+			logger.Info(fmt.Sprintf("%s is ready (%v).", what, time.Since(start).Round(time.Second)))
+			return nil
+		}
+		var permanent permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+
+		if time.Since(lastProgress) >= progressInterval {
+			logger.Message(fmt.Sprintf("Waiting on %s (attempt %d): %v. Retrying in %v...", what, attempt, err, delay))
+			lastProgress = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("%s wasn't ready after %v: %v", what, timeout, err)
+			}
+			return fmt.Errorf("stopped waiting on %s", what)
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// Logs into master
+func checkServer(ctx context.Context, database config.DB) error {
+	db, err := open(database, "master")
+	if err != nil {
+		return permanentError{err}
+	}
+	defer db.Close()
+	return failLogins(db.PingContext(ctx))
+}
+
+// Checks the database's state from master, then logs into it
+func checkDatabase(ctx context.Context, database config.DB) error {
+	master, err := open(database, "master")
+	if err != nil {
+		return permanentError{err}
+	}
+	defer master.Close()
+
+	var state, access string
+	err = master.QueryRowContext(ctx, "SELECT state_desc, user_access_desc FROM sys.databases WHERE name = @p1", database.Name).Scan(&state, &access)
+	if err == sql.ErrNoRows {
+		return permanentError{fmt.Errorf("database '%s' doesn't exist", database.Name)}
+	} else if err != nil {
+		return err
+	}
+	if state != "ONLINE" {
+		return fmt.Errorf("database is %s", state)
+	}
+	if access == "SINGLE_USER" {
+		return fmt.Errorf("database is in single user mode")
+	}
+
+	db, err := open(database, database.Name)
+	if err != nil {
+		return permanentError{err}
+	}
+	defer db.Close()
+	return failLogins(db.PingContext(ctx))
+}
+
+// A rejected login means the server is up and turned us away, which no amount of waiting will fix
+func failLogins(err error) error {
+	var sqlErr mssql.Error
+	if errors.As(err, &sqlErr) && sqlErr.Number == loginFailedError {
+		return permanentError{err}
+	}
+	return err
+}
+
+func open(database config.DB, name string) (*sql.DB, error) {
+	connString := fmt.Sprintf("server=%s;port=%s;user id=%s;password=%s;database=%s", database.Host, database.Port, database.Username, database.Password, name)
+	return sql.Open("sqlserver", connString)
+}
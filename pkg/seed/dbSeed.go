@@ -7,6 +7,8 @@ import (
 	_ "github.com/denisenkom/go-mssqldb"
 	"github.com/jlammilliman/dbManager/pkg/config"
 	"github.com/jlammilliman/dbManager/pkg/logger"
+	"github.com/jlammilliman/dbManager/pkg/readiness"
+	"github.com/jlammilliman/dbManager/pkg/setup"
 )
 
 // This list will be used to filter out any tables that we absolutely do not want to seed
@@ -22,9 +24,9 @@ func Exec(config *config.Config, forceRefresh bool) {
 	username := config.TargetDB.Username
 	password := config.TargetDB.Password
 
-	isDBConnected := isSQLServerContainerReady(server, port, username, password)
-	if !isDBConnected {
-		fmt.Println("No active DB connection found. Checking for docker setup...")
+	if err := readiness.WaitForDatabase(config.ReadyTimeout, config.TargetDB); err != nil {
+		logger.Error(fmt.Sprintf("No active DB connection found: %v", err))
+		return
 	}
 
 	connString := fmt.Sprintf("server=%s;port=%s;user id=%s;password=%s;database=%s", server, port, username, password, database)
@@ -59,7 +61,7 @@ func Exec(config *config.Config, forceRefresh bool) {
 		} else {
 			err := CallGeneralStrategy(db, table) // Default to seed method
 			if err != nil {
-				logger.Error(fmt.Sprintf("SEEDING FAILED on '%s': %v", table.TableName, err))
+				logger.Error(fmt.Sprintf("SEEDING FAILED on '%s': %v", qualifiedName(table.SchemaName, table.TableName), err))
 			} else {
 				seedCount++
 			}
@@ -68,20 +70,6 @@ func Exec(config *config.Config, forceRefresh bool) {
 	logger.Info(fmt.Sprintf("Seeded %d of %d tables on '%s'", seedCount, len(sortedTables), database))
 }
 
-// Sanity check that a database connection exists before we try to seed it
-func isSQLServerContainerReady(server, port, username, password string) bool {
-	connString := fmt.Sprintf("server=%s;port=%s;user id=%s;password=%s;database=master", server, port, username, password)
-	db, err := sql.Open("sqlserver", connString)
-	if err != nil {
-		fmt.Println(err)
-		return false
-	}
-	defer db.Close()
-
-	err = db.Ping()
-	return err == nil
-}
-
 // Query to get all tables and their columns, contraints
 func getTables(db *sql.DB, database string) ([]TableDetails, error) {
 
@@ -90,46 +78,45 @@ func getTables(db *sql.DB, database string) ([]TableDetails, error) {
 	-- Generate temp tables to assist with the SQL side topographical sorting
 	WITH PrimaryKeys AS (
 		SELECT 
+			tc.TABLE_SCHEMA,
 			tc.TABLE_NAME,
 			kcu.COLUMN_NAME
 		FROM INFORMATION_SCHEMA.TABLE_CONSTRAINTS tc
 		JOIN INFORMATION_SCHEMA.KEY_COLUMN_USAGE kcu 
-			ON kcu.CONSTRAINT_NAME = tc.CONSTRAINT_NAME 
+			ON kcu.CONSTRAINT_SCHEMA = tc.CONSTRAINT_SCHEMA AND kcu.CONSTRAINT_NAME = tc.CONSTRAINT_NAME 
 		WHERE tc.CONSTRAINT_TYPE = 'PRIMARY KEY'
-	),
-	ForeignKeys AS (
-		SELECT 
-			kcu.TABLE_NAME, 
-			kcu.COLUMN_NAME, 
-			rc1.UNIQUE_CONSTRAINT_NAME AS REFERENCED_CONSTRAINT_NAME,
-			kcu2.TABLE_NAME AS REFERENCED_TABLE_NAME,
-			kcu2.COLUMN_NAME AS REFERENCED_COLUMN_NAME
-		FROM INFORMATION_SCHEMA.KEY_COLUMN_USAGE kcu
-		JOIN INFORMATION_SCHEMA.REFERENTIAL_CONSTRAINTS rc1 
-			ON kcu.CONSTRAINT_NAME = rc1.CONSTRAINT_NAME
-		JOIN INFORMATION_SCHEMA.KEY_COLUMN_USAGE kcu2 
-			ON rc1.UNIQUE_CONSTRAINT_NAME = kcu2.CONSTRAINT_NAME
 	)
 
 	SELECT 
+		c.TABLE_SCHEMA,
 		c.TABLE_NAME,
 		c.COLUMN_NAME,
 		c.DATA_TYPE,
 		COALESCE(c.CHARACTER_MAXIMUM_LENGTH, 0), -- Gets the size limit, or sets it to 0
+		COALESCE(c.NUMERIC_PRECISION, 0),
+		COALESCE(c.NUMERIC_SCALE, 0),
 		c.COLUMN_DEFAULT,
+		c.IS_NULLABLE,
+		sc.is_identity,
+		sc.is_computed,
+		c.COLLATION_NAME,
 		CASE 
 			WHEN pk.COLUMN_NAME IS NOT NULL THEN 'YES'
 			ELSE 'NO'
-		END AS IS_PRIMARY_KEY,
-		fk.REFERENCED_TABLE_NAME,
-		fk.REFERENCED_COLUMN_NAME
+		END AS IS_PRIMARY_KEY
 	FROM INFORMATION_SCHEMA.COLUMNS c
-		LEFT JOIN PrimaryKeys pk ON c.TABLE_NAME = pk.TABLE_NAME AND c.COLUMN_NAME = pk.COLUMN_NAME
-		LEFT JOIN ForeignKeys fk ON c.TABLE_NAME = fk.TABLE_NAME AND c.COLUMN_NAME = fk.COLUMN_NAME
-	JOIN INFORMATION_SCHEMA.TABLES t ON c.TABLE_NAME = t.TABLE_NAME AND c.TABLE_CATALOG = t.TABLE_CATALOG
+		LEFT JOIN PrimaryKeys pk 
+			ON c.TABLE_SCHEMA = pk.TABLE_SCHEMA AND c.TABLE_NAME = pk.TABLE_NAME AND c.COLUMN_NAME = pk.COLUMN_NAME
+	JOIN INFORMATION_SCHEMA.TABLES t 
+		ON c.TABLE_SCHEMA = t.TABLE_SCHEMA AND c.TABLE_NAME = t.TABLE_NAME AND c.TABLE_CATALOG = t.TABLE_CATALOG
+	-- INFORMATION_SCHEMA has no idea about identities or computed columns, so pull those from the catalog views
+	JOIN sys.columns sc 
+		ON sc.object_id = OBJECT_ID(QUOTENAME(c.TABLE_SCHEMA) + '.' + QUOTENAME(c.TABLE_NAME)) AND sc.name = c.COLUMN_NAME
 	WHERE 
 		c.TABLE_CATALOG = '` + database + `'
 		AND t.TABLE_TYPE = 'BASE TABLE' -- Filter out views
+		AND NOT (c.TABLE_SCHEMA = '` + setup.HistorySchemaName + `' AND c.TABLE_NAME IN ('` + setup.HistoryTableName + `', '` + setup.VersionTableName + `')) -- Setup's own bookkeeping
+	ORDER BY c.TABLE_SCHEMA, c.TABLE_NAME, c.ORDINAL_POSITION
 	`
 	rows, err := db.Query(query)
 	if err != nil {
@@ -141,31 +128,44 @@ func getTables(db *sql.DB, database string) ([]TableDetails, error) {
 	tablesMap := make(map[string]*TableDetails)
 	for rows.Next() {
 		var (
-			tableName        string
-			columnName       string
-			dataType         string
-			isPrimaryKeyStr  string
-			referencedTable  sql.NullString
-			referencedColumn sql.NullString
-			columnSize       int
-			columnDefault    sql.NullString
+			schemaName      string
+			tableName       string
+			columnName      string
+			dataType        string
+			isPrimaryKeyStr string
+			columnSize      int
+			precision       int
+			scale           int
+			columnDefault   sql.NullString
+			isNullableStr   string
+			isIdentity      bool
+			isComputed      bool
+			collation       sql.NullString
 		)
-		err := rows.Scan(&tableName, &columnName, &dataType, &columnSize, &columnDefault, &isPrimaryKeyStr, &referencedTable, &referencedColumn)
+		err := rows.Scan(&schemaName, &tableName, &columnName, &dataType, &columnSize, &precision, &scale, &columnDefault, &isNullableStr,
+			&isIdentity, &isComputed, &collation, &isPrimaryKeyStr)
 		if err != nil {
 			return nil, err
 		}
 
-		if _, exists := tablesMap[tableName]; !exists {
-			tablesMap[tableName] = &TableDetails{TableName: tableName}
+		// Table names are only unique within a schema
+		key := qualifiedName(schemaName, tableName)
+		if _, exists := tablesMap[key]; !exists {
+			tablesMap[key] = &TableDetails{SchemaName: schemaName, TableName: tableName}
 		}
 
 		column := ColumnDetails{
-			Name:             columnName,
-			Type:             dataType,
-			IsPrimaryKey:     isPrimaryKeyStr == "YES",
-			ReferencedTable:  referencedTable.String,
-			ReferencedColumn: referencedColumn.String,
-			ColumnSize:       columnSize,
+			Name:         columnName,
+			Type:         dataType,
+			IsPrimaryKey: isPrimaryKeyStr == "YES",
+			ColumnSize:   columnSize,
+			Precision:    precision,
+			Scale:        scale,
+			IsNullable:   isNullableStr == "YES",
+			IsIdentity:   isIdentity,
+			IsComputed:   isComputed,
+			Collation:    collation.String,
+			IsRowVersion: dataType == "timestamp" || dataType == "rowversion", // INFORMATION_SCHEMA still calls rowversion 'timestamp'
 		}
 
 		if columnDefault.Valid {
@@ -174,13 +174,24 @@ func getTables(db *sql.DB, database string) ([]TableDetails, error) {
 			column.ColumnDefault = ""
 		}
 
-		tablesMap[tableName].Columns = append(tablesMap[tableName].Columns, column)
+		tablesMap[key].Columns = append(tablesMap[key].Columns, column)
+	}
+
+	// Foreign keys may span several columns, so they're looked up as whole constraints
+	foreignKeys, err := getForeignKeys(db)
+	if err != nil {
+		return nil, err
+	}
+	for key, keys := range foreignKeys {
+		if table, exists := tablesMap[key]; exists {
+			table.ForeignKeys = keys
+		}
 	}
 
 	// Recast to new object to avoid any overlapping/dead data. --> Old array gets garbage collected
 	var tables []TableDetails
 	for _, table := range tablesMap {
-		if !stringInSlice(table.TableName, BlockedFromSeeding) {
+		if !isBlockedFromSeeding(*table) {
 			tables = append(tables, *table)
 		}
 	}
@@ -189,6 +200,60 @@ func getTables(db *sql.DB, database string) ([]TableDetails, error) {
 	return tables, nil
 }
 
+// Query to get every foreign key constraint, keyed by the schema qualified table it lives on
+func getForeignKeys(db *sql.DB) (map[string][]ForeignKeyDetails, error) {
+	query := `
+	SELECT 
+		OBJECT_SCHEMA_NAME(fk.parent_object_id) AS TABLE_SCHEMA,
+		OBJECT_NAME(fk.parent_object_id) AS TABLE_NAME,
+		fk.name AS CONSTRAINT_NAME,
+		OBJECT_SCHEMA_NAME(fk.referenced_object_id) AS REFERENCED_TABLE_SCHEMA,
+		OBJECT_NAME(fk.referenced_object_id) AS REFERENCED_TABLE_NAME,
+		pc.name AS COLUMN_NAME,
+		rc.name AS REFERENCED_COLUMN_NAME
+	FROM sys.foreign_keys fk
+	JOIN sys.foreign_key_columns fkc ON fkc.constraint_object_id = fk.object_id
+	JOIN sys.columns pc ON pc.object_id = fkc.parent_object_id AND pc.column_id = fkc.parent_column_id
+	JOIN sys.columns rc ON rc.object_id = fkc.referenced_object_id AND rc.column_id = fkc.referenced_column_id
+	ORDER BY TABLE_SCHEMA, TABLE_NAME, CONSTRAINT_NAME, fkc.constraint_column_id -- Keeps column pairs in key order
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	foreignKeys := make(map[string][]ForeignKeyDetails)
+	for rows.Next() {
+		var (
+			schemaName       string
+			tableName        string
+			constraintName   string
+			referencedSchema string
+			referencedTable  string
+			columnName       string
+			referencedColumn string
+		)
+		err := rows.Scan(&schemaName, &tableName, &constraintName, &referencedSchema, &referencedTable, &columnName, &referencedColumn)
+		if err != nil {
+			return nil, err
+		}
+
+		// Rows come back grouped by constraint, so we only ever need to check the last key on the table
+		table := qualifiedName(schemaName, tableName)
+		keys := foreignKeys[table]
+		if len(keys) == 0 || keys[len(keys)-1].Name != constraintName {
+			keys = append(keys, ForeignKeyDetails{Name: constraintName, ReferencedSchema: referencedSchema, ReferencedTable: referencedTable})
+		}
+		key := &keys[len(keys)-1]
+		key.Columns = append(key.Columns, columnName)
+		key.ReferencedColumns = append(key.ReferencedColumns, referencedColumn)
+		foreignKeys[table] = keys
+	}
+
+	return foreignKeys, nil
+}
+
 /*
 	BEGIN sorting. It is more cost efficient to sort in golang than within SQL server
 	We use a topological sort to ensure the following:
@@ -234,6 +299,17 @@ func topologicalSort(graph map[string][]string) ([]string, error) {
 	return order, nil
 }
 
+// Builds the schema.name key we use to identify tables across schemas
+func qualifiedName(schemaName, tableName string) string {
+	return schemaName + "." + tableName
+}
+
+// Tables can be blocked by bare name (any schema) or by schema qualified name
+func isBlockedFromSeeding(table TableDetails) bool {
+	return stringInSlice(table.TableName, BlockedFromSeeding) ||
+		stringInSlice(qualifiedName(table.SchemaName, table.TableName), BlockedFromSeeding)
+}
+
 // Checks for existence of a string in a given array
 func stringInSlice(a string, list []string) bool {
 	for _, b := range list {
@@ -251,18 +327,21 @@ func sortTables(tables []TableDetails) ([]TableDetails, error) {
 	logger.Debug("Beggining Table sort...")
 	for _, table := range tables {
 		var addedTable = false // flag to ensure all tables make it into the graph
-		logger.Debug(fmt.Sprintf("Building columns for '%s'...", table.TableName))
-		for _, col := range table.Columns {
-			if col.ReferencedTable != "" {
-				logger.Debug(fmt.Sprintf("APPENDING:'%s':'%s' on column: '%s'", table.TableName, col.ReferencedTable, col.Name))
-				graph[table.TableName] = append(graph[table.TableName], col.ReferencedTable)
+		node := qualifiedName(table.SchemaName, table.TableName)
+		logger.Debug(fmt.Sprintf("Building columns for '%s'...", node))
+		for _, key := range table.ForeignKeys {
+			// A table pointing at itself can pick from its own rows (or NULL), it doesn't need to wait on anything
+			dependency := qualifiedName(key.ReferencedSchema, key.ReferencedTable)
+			if dependency != node {
+				logger.Debug(fmt.Sprintf("APPENDING:'%s':'%s' on key: '%s'", node, dependency, key.Name))
+				graph[node] = append(graph[node], dependency)
 				addedTable = true
 			}
 		}
 
 		if !addedTable {
-			logger.Debug(fmt.Sprintf("'%s' has no dependencies", table.TableName))
-			graph[table.TableName] = append(graph[table.TableName], "")
+			logger.Debug(fmt.Sprintf("'%s' has no dependencies", node))
+			graph[node] = append(graph[node], "")
 		}
 	}
 	logger.PrintDivide(true)
@@ -282,8 +361,8 @@ func sortTables(tables []TableDetails) ([]TableDetails, error) {
 	var sortedTables []TableDetails
 	for _, tableName := range order {
 		for _, table := range tables {
-			if table.TableName == tableName {
-				isBlocked := stringInSlice(table.TableName, BlockedFromSeeding)
+			if qualifiedName(table.SchemaName, table.TableName) == tableName {
+				isBlocked := isBlockedFromSeeding(table)
 				if !isBlocked {
 					table.NumSeeds = 3 // Default number of values to seed for the table
 					sortedTables = append(sortedTables, table)
@@ -0,0 +1,686 @@
+package seed
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jlammilliman/dbManager/pkg/config"
+	"github.com/jlammilliman/dbManager/pkg/logger"
+	"github.com/jlammilliman/dbManager/pkg/readiness"
+	"github.com/jlammilliman/dbManager/pkg/setup"
+)
+
+/*
+	Subsetting copies real rows from source into target, instead of making some up.
+
+	It starts from the configured root tables (SUBSET_ROOTS), then follows foreign keys out from every row it has:
+		1) Up, to the rows it references. Without these the row can't be inserted at all
+		2) Down, to the rows that reference it. These are what make the data worth having, ie: an employee's timesheets
+	Rows only pulled in because something referenced them are followed up but not down. Otherwise a shared
+	lookup row would drag in everything that uses it, and with it most of the database.
+
+	The rows are then inserted into target in the same order seeding uses, keeping their keys (identities included),
+	all in one transaction. Rows already in target are left alone (by primary key, or by every column on a table
+	without one), so a subset can be rerun.
+*/
+
+// SQL Server takes at most 2100 parameters, leave some room
+var maxSubsetParams = 2000
+
+// A row, keyed by column name
+type subsetRow map[string]interface{}
+
+type subsetTable struct {
+	details    TableDetails
+	keyColumns []string // The primary key, or every column for a table without one
+	rows       map[string]subsetRow
+	order      []string        // Row keys in the order they were found, keeps inserts stable
+	expanded   map[string]bool // Rows whose dependents have been pulled in
+}
+
+// A foreign key pointing at a table, along with the table it lives on
+type dependentKey struct {
+	table string
+	key   ForeignKeyDetails
+}
+
+type subset struct {
+	db         *sql.DB
+	tables     map[string]*subsetTable
+	dependents map[string][]dependentKey
+	warned     map[string]bool
+}
+
+// Rows that still need their foreign keys followed
+type subsetWork struct {
+	table          string
+	rows           []subsetRow
+	withDependents bool
+}
+
+// Copies a referentially consistent subset of source into target. Returns false if anything went wrong.
+func Subset(config *config.Config) bool {
+	if len(config.SubsetRoots) == 0 {
+		logger.Error("No subset roots configured. List the tables to start from in SUBSET_ROOTS, ie: SUBSET_ROOTS=dbo.Users")
+		return false
+	}
+
+	if err := readiness.WaitForDatabase(config.ReadyTimeout, config.SourceDB); err != nil {
+		logger.Error(fmt.Sprintf("No active DB connection found: %v", err))
+		return false
+	}
+	// Keys are copied as is, and IDENTITY_INSERT needs more than the app login's read/write access
+	targetDB := config.TargetDB
+	targetDB.Username = config.Admin.Username
+	targetDB.Password = config.Admin.Password
+	if err := readiness.WaitForDatabase(config.ReadyTimeout, targetDB); err != nil {
+		logger.Error(fmt.Sprintf("No active DB connection found: %v", err))
+		return false
+	}
+
+	source, err := openConfiguredDatabase(config.SourceDB)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to open database '%s': %v", config.SourceDB.Name, err))
+		return false
+	}
+	defer source.Close()
+
+	tables, err := getTables(source, config.SourceDB.Name)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to lookup tables. Error: %v", err))
+		return false
+	}
+
+	s := newSubset(source, tables)
+	var work []subsetWork
+	for _, root := range config.SubsetRoots {
+		table, err := s.findTable(root.Table)
+		if err != nil {
+			logger.Error(err.Error())
+			return false
+		}
+		rows, err := s.fetchRoot(table, root)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to read root '%s': %v", root.Table, err))
+			return false
+		}
+		logger.Debug(fmt.Sprintf("Starting from %d row(s) of '%s'.", len(rows), table))
+		work = append(work, s.add(table, rows, true)...)
+	}
+
+	// Breadth first, so the log reads outward from the roots
+	for len(work) > 0 {
+		next := work[0]
+		work = work[1:]
+		more, err := s.follow(next)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to follow keys from '%s': %v", next.table, err))
+			return false
+		}
+		work = append(work, more...)
+	}
+
+	target, err := openConfiguredDatabase(targetDB)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to open database '%s': %v", config.TargetDB.Name, err))
+		return false
+	}
+	defer target.Close()
+
+	if err := s.insert(target); err != nil {
+		logger.Error(fmt.Sprintf("SUBSET FAILED, nothing was copied: %v", err))
+		return false
+	}
+	return true
+}
+
+func openConfiguredDatabase(database config.DB) (*sql.DB, error) {
+	connString := fmt.Sprintf("server=%s;port=%s;user id=%s;password=%s;database=%s", database.Host, database.Port, database.Username, database.Password, database.Name)
+	return sql.Open("sqlserver", connString)
+}
+
+func newSubset(db *sql.DB, tables []TableDetails) *subset {
+	s := &subset{
+		db:         db,
+		tables:     make(map[string]*subsetTable),
+		dependents: make(map[string][]dependentKey),
+		warned:     make(map[string]bool),
+	}
+
+	for _, table := range tables {
+		name := qualifiedName(table.SchemaName, table.TableName)
+		subsetTable := &subsetTable{details: table, rows: make(map[string]subsetRow), expanded: make(map[string]bool)}
+		for _, col := range table.Columns {
+			if col.IsPrimaryKey {
+				subsetTable.keyColumns = append(subsetTable.keyColumns, col.Name)
+			}
+		}
+		if len(subsetTable.keyColumns) == 0 {
+			for _, col := range table.Columns {
+				subsetTable.keyColumns = append(subsetTable.keyColumns, col.Name)
+			}
+		}
+		s.tables[name] = subsetTable
+
+		for _, key := range table.ForeignKeys {
+			referenced := qualifiedName(key.ReferencedSchema, key.ReferencedTable)
+			s.dependents[referenced] = append(s.dependents[referenced], dependentKey{table: name, key: key})
+		}
+	}
+	return s
+}
+
+// Finds a root by schema.table, or by bare name if that's unique
+func (s *subset) findTable(name string) (string, error) {
+	if _, exists := s.tables[name]; exists {
+		return name, nil
+	}
+
+	var matches []string
+	for key, table := range s.tables {
+		if strings.EqualFold(table.details.TableName, name) || strings.EqualFold(key, name) {
+			matches = append(matches, key)
+		}
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("subset root '%s' isn't a table in source (or it's blocked from seeding)", name)
+	}
+	if len(matches) > 1 {
+		return "", fmt.Errorf("subset root '%s' is ambiguous, use one of: %s", name, strings.Join(matches, ", "))
+	}
+	return matches[0], nil
+}
+
+// Reads the rows a root starts from
+func (s *subset) fetchRoot(name string, root config.SubsetRoot) ([]subsetRow, error) {
+	table := s.tables[name]
+	query := fmt.Sprintf("SELECT TOP (%d) %s FROM %s", root.Limit, quotedColumnNames(table.details.Columns), setup.QuoteQualifiedName(table.details.SchemaName, table.details.TableName))
+	if root.Where != "" {
+		query += " WHERE " + root.Where
+	}
+	// Without a primary key there may be nothing sortable to order by
+	if len(table.keyColumns) < len(table.details.Columns) {
+		query += " ORDER BY " + setup.QuoteNames(table.keyColumns)
+	}
+	return s.query(table, query)
+}
+
+// Adds rows to the subset, returning the work needed to follow the ones that are new to it
+func (s *subset) add(name string, rows []subsetRow, withDependents bool) []subsetWork {
+	table := s.tables[name]
+	var fresh, expand []subsetRow
+	for _, row := range rows {
+		key := rowKey(row, table.keyColumns)
+		if _, exists := table.rows[key]; !exists {
+			table.rows[key] = row
+			table.order = append(table.order, key)
+			fresh = append(fresh, row)
+		}
+		// A row first seen as someone's parent still gets its dependents once something reaches it from above
+		if withDependents && !table.expanded[key] {
+			table.expanded[key] = true
+			expand = append(expand, table.rows[key])
+		}
+	}
+
+	var work []subsetWork
+	if len(fresh) > 0 {
+		work = append(work, subsetWork{table: name, rows: fresh})
+	}
+	if len(expand) > 0 {
+		work = append(work, subsetWork{table: name, rows: expand, withDependents: true})
+	}
+	return work
+}
+
+// Follows foreign keys out of a batch of rows: up for new rows, down for rows being expanded
+func (s *subset) follow(work subsetWork) ([]subsetWork, error) {
+	table := s.tables[work.table]
+	var more []subsetWork
+
+	if !work.withDependents {
+		for _, key := range table.details.ForeignKeys {
+			referenced := qualifiedName(key.ReferencedSchema, key.ReferencedTable)
+			if !s.isKnown(referenced, key.Name) {
+				continue
+			}
+			rows, err := s.fetchMatching(referenced, key.ReferencedColumns, keyValues(work.rows, key.Columns))
+			if err != nil {
+				return nil, err
+			}
+			more = append(more, s.add(referenced, rows, false)...)
+		}
+		return more, nil
+	}
+
+	for _, dependent := range s.dependents[work.table] {
+		if !s.isKnown(dependent.table, dependent.key.Name) {
+			continue
+		}
+		rows, err := s.fetchMatching(dependent.table, dependent.key.Columns, keyValues(work.rows, dependent.key.ReferencedColumns))
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) > 0 {
+			logger.Debug(fmt.Sprintf("'%s' -> %d row(s) of '%s' on key '%s'.", work.table, len(rows), dependent.table, dependent.key.Name))
+		}
+		more = append(more, s.add(dependent.table, rows, true)...)
+	}
+	return more, nil
+}
+
+// Blocked tables aren't in the subset, so keys into and out of them can't be followed
+func (s *subset) isKnown(name, keyName string) bool {
+	if _, exists := s.tables[name]; exists {
+		return true
+	}
+	if !s.warned[keyName] {
+		s.warned[keyName] = true
+		logger.Warning(fmt.Sprintf("Not following '%s', '%s' is blocked from seeding. Target needs those rows already.", keyName, name))
+	}
+	return false
+}
+
+// Reads every row of a table whose columns match one of the given value tuples
+func (s *subset) fetchMatching(name string, columns []string, tuples [][]interface{}) ([]subsetRow, error) {
+	table := s.tables[name]
+	chunkSize := maxSubsetParams / len(columns)
+
+	var rows []subsetRow
+	for start := 0; start < len(tuples); start += chunkSize {
+		end := start + chunkSize
+		if end > len(tuples) {
+			end = len(tuples)
+		}
+
+		var conditions []string
+		var args []interface{}
+		for _, tuple := range tuples[start:end] {
+			var parts []string
+			for i, column := range columns {
+				args = append(args, tuple[i])
+				parts = append(parts, fmt.Sprintf("%s = @p%d", setup.QuoteName(column), len(args)))
+			}
+			conditions = append(conditions, "("+strings.Join(parts, " AND ")+")")
+		}
+
+		query := fmt.Sprintf("SELECT %s FROM %s WHERE %s", quotedColumnNames(table.details.Columns),
+			setup.QuoteQualifiedName(table.details.SchemaName, table.details.TableName), strings.Join(conditions, " OR "))
+		chunk, err := s.query(table, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, chunk...)
+	}
+	return rows, nil
+}
+
+func (s *subset) query(table *subsetTable, query string, args ...interface{}) ([]subsetRow, error) {
+	results, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	var rows []subsetRow
+	for results.Next() {
+		values := make([]interface{}, len(table.details.Columns))
+		pointers := make([]interface{}, len(values))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := results.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		row := make(subsetRow)
+		for i, col := range table.details.Columns {
+			row[col.Name] = normalizeValue(col, values[i])
+		}
+		rows = append(rows, row)
+	}
+	return rows, results.Err()
+}
+
+// The driver hands decimals back as raw text, which SQL Server won't take back as binary
+func normalizeValue(col ColumnDetails, value interface{}) interface{} {
+	if raw, ok := value.([]byte); ok {
+		switch strings.ToLower(col.Type) {
+		case "decimal", "numeric", "money", "smallmoney":
+			return string(raw)
+		}
+	}
+	return value
+}
+
+// The distinct, fully non-NULL values of some columns across rows. A NULL in any of them means there's nothing to follow
+func keyValues(rows []subsetRow, columns []string) [][]interface{} {
+	var tuples [][]interface{}
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		tuple := make([]interface{}, len(columns))
+		complete := true
+		for i, column := range columns {
+			if row[column] == nil {
+				complete = false
+				break
+			}
+			tuple[i] = row[column]
+		}
+		if !complete {
+			continue
+		}
+
+		key := rowKey(row, columns)
+		if !seen[key] {
+			seen[key] = true
+			tuples = append(tuples, tuple)
+		}
+	}
+	return tuples
+}
+
+func rowKey(row subsetRow, columns []string) string {
+	parts := make([]string, len(columns))
+	for i, column := range columns {
+		parts[i] = fmt.Sprintf("%v", row[column])
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// A foreign key that closes a cycle between tables. No insert order satisfies it, so it's disabled while inserting
+type deferredKey struct {
+	table        TableDetails
+	key          ForeignKeyDetails
+	isDisabled   bool // As found on the target, so the key can be put back the way it was
+	isNotTrusted bool
+}
+
+// Orders tables parents first, like sortTables, but a cycle (ie: Department.ManagerId <-> Employee.DepartmentId)
+// doesn't stop it: the key that closes the cycle is handed back to be disabled instead
+func orderSubsetTables(tables []TableDetails) ([]TableDetails, []deferredKey) {
+	byName := make(map[string]TableDetails)
+	var names []string
+	for _, table := range tables {
+		name := qualifiedName(table.SchemaName, table.TableName)
+		byName[name] = table
+		names = append(names, name)
+	}
+	sort.Strings(names) // Keeps the order stable between runs
+
+	var ordered []TableDetails
+	var deferred []deferredKey
+	visiting := make(map[string]bool)
+	done := make(map[string]bool)
+
+	var visit func(name string)
+	visit = func(name string) {
+		visiting[name] = true
+		for _, key := range byName[name].ForeignKeys {
+			referenced := qualifiedName(key.ReferencedSchema, key.ReferencedTable)
+			if _, inSubset := byName[referenced]; !inSubset || referenced == name || done[referenced] {
+				continue // Self references are ordered row by row instead
+			}
+			if visiting[referenced] {
+				deferred = append(deferred, deferredKey{table: byName[name], key: key})
+				continue
+			}
+			visit(referenced)
+		}
+		visiting[name] = false
+		done[name] = true
+		ordered = append(ordered, byName[name])
+	}
+
+	for _, name := range names {
+		if !done[name] {
+			visit(name)
+		}
+	}
+	return ordered, deferred
+}
+
+// Inserts the subset into target, parents before children, in a single transaction
+func (s *subset) insert(target *sql.DB) error {
+	var tables []TableDetails
+	for _, table := range s.tables {
+		if len(table.rows) > 0 {
+			tables = append(tables, table.details)
+		}
+	}
+	sortedTables, deferred := orderSubsetTables(tables)
+
+	// IDENTITY_INSERT only holds for the session that turned it on
+	conn, err := target.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+
+	for i := range deferred {
+		key := &deferred[i]
+		tableName := setup.QuoteQualifiedName(key.table.SchemaName, key.table.TableName)
+		err := tx.QueryRow("SELECT is_disabled, is_not_trusted FROM sys.foreign_keys WHERE name = @p1 AND parent_object_id = OBJECT_ID(@p2)",
+			key.key.Name, tableName).Scan(&key.isDisabled, &key.isNotTrusted)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to look up '%s' on the target: %v", key.key.Name, err)
+		}
+		if key.isDisabled {
+			continue // Already off, and stays that way
+		}
+
+		logger.Warning(fmt.Sprintf("'%s' is part of a cycle between tables, it's checked once every row is in.", key.key.Name))
+		query := fmt.Sprintf("ALTER TABLE %s NOCHECK CONSTRAINT %s;", tableName, setup.QuoteName(key.key.Name))
+		if _, err := tx.Exec(query); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to disable '%s': %v", key.key.Name, err)
+		}
+	}
+
+	total := 0
+	for _, details := range sortedTables {
+		table := s.tables[qualifiedName(details.SchemaName, details.TableName)]
+		inserted, err := insertSubsetTable(tx, table)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("'%s': %v", qualifiedName(details.SchemaName, details.TableName), err)
+		}
+		logger.Info(fmt.Sprintf("COPIED: '%s' %d of %d rows.", qualifiedName(details.SchemaName, details.TableName), inserted, len(table.rows)))
+		total += inserted
+	}
+
+	// Put each key back the way it was. WITH CHECK checks every row so a trusted key stays trusted, an untrusted one is
+	// only switched back on, and a disabled one is left alone
+	for _, key := range deferred {
+		if key.isDisabled {
+			continue
+		}
+		check := "WITH CHECK"
+		if key.isNotTrusted {
+			check = "WITH NOCHECK"
+		}
+		query := fmt.Sprintf("ALTER TABLE %s %s CHECK CONSTRAINT %s;", setup.QuoteQualifiedName(key.table.SchemaName, key.table.TableName), check, setup.QuoteName(key.key.Name))
+		if _, err := tx.Exec(query); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("rows copied don't satisfy '%s': %v", key.key.Name, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	logger.Info(fmt.Sprintf("Copied %d rows across %d tables.", total, len(sortedTables)))
+	return nil
+}
+
+// Types that can't be compared with =, so they can't tell two rows apart
+func isComparableType(dataType string) bool {
+	switch strings.ToLower(dataType) {
+	case "text", "ntext", "image", "xml", "geometry", "geography":
+		return false
+	}
+	return true
+}
+
+func insertSubsetTable(tx *sql.Tx, table *subsetTable) (int, error) {
+	tableName := setup.QuoteQualifiedName(table.details.SchemaName, table.details.TableName)
+
+	var columns, guardColumns []string
+	hasIdentity := false
+	hasPrimaryKey := false
+	for _, col := range table.details.Columns {
+		// SQL Server refuses explicit values for these
+		if col.IsComputed || col.IsRowVersion {
+			continue
+		}
+		hasIdentity = hasIdentity || col.IsIdentity
+		hasPrimaryKey = hasPrimaryKey || col.IsPrimaryKey
+		columns = append(columns, col.Name)
+	}
+	if len(columns) == 0 {
+		return 0, nil
+	}
+
+	// Rows already in target are skipped, by primary key. Without one, a row only counts as there if every column matches
+	if hasPrimaryKey {
+		guardColumns = table.keyColumns
+	} else {
+		for _, col := range table.details.Columns {
+			if !col.IsComputed && !col.IsRowVersion && isComparableType(col.Type) {
+				guardColumns = append(guardColumns, col.Name)
+			}
+		}
+	}
+
+	// Keys are copied as is, identities included, so everything pointing at them still lines up
+	if hasIdentity {
+		if _, err := tx.Exec(fmt.Sprintf("SET IDENTITY_INSERT %s ON;", tableName)); err != nil {
+			return 0, err
+		}
+	}
+
+	holders := make([]string, len(columns))
+	for i := range columns {
+		holders[i] = fmt.Sprintf("@p%d", i+1)
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s);", tableName, setup.QuoteNames(columns), strings.Join(holders, ", "))
+
+	inserted := 0
+	for _, row := range orderSelfReferences(table) {
+		var values []interface{}
+		for _, column := range columns {
+			values = append(values, row[column])
+		}
+
+		// NULL never equals anything, so the guard is built per row
+		var conditions []string
+		for _, column := range guardColumns {
+			if row[column] == nil {
+				conditions = append(conditions, fmt.Sprintf("%s IS NULL", setup.QuoteName(column)))
+				continue
+			}
+			values = append(values, row[column])
+			conditions = append(conditions, fmt.Sprintf("%s = @p%d", setup.QuoteName(column), len(values)))
+		}
+		query := insert
+		if len(conditions) > 0 {
+			query = fmt.Sprintf("IF NOT EXISTS (SELECT 1 FROM %s WHERE %s) %s", tableName, strings.Join(conditions, " AND "), insert)
+		}
+
+		result, err := tx.Exec(query, values...)
+		if err != nil {
+			return 0, err
+		}
+		if affected, err := result.RowsAffected(); err == nil {
+			inserted += int(affected)
+		}
+	}
+
+	if hasIdentity {
+		if _, err := tx.Exec(fmt.Sprintf("SET IDENTITY_INSERT %s OFF;", tableName)); err != nil {
+			return 0, err
+		}
+	}
+	return inserted, nil
+}
+
+// A table pointing at itself (ie: an employee's manager) needs the referenced rows in first.
+// Rows that can't be ordered (a cycle) go last, in the order they were found.
+func orderSelfReferences(table *subsetTable) []subsetRow {
+	node := qualifiedName(table.details.SchemaName, table.details.TableName)
+	var selfKeys []ForeignKeyDetails
+	for _, key := range table.details.ForeignKeys {
+		if qualifiedName(key.ReferencedSchema, key.ReferencedTable) == node {
+			selfKeys = append(selfKeys, key)
+		}
+	}
+
+	var pending []subsetRow
+	for _, key := range table.order {
+		pending = append(pending, table.rows[key])
+	}
+	if len(selfKeys) == 0 {
+		return pending
+	}
+
+	// Which rows are in the subset, and which are inserted so far, by the columns each key references
+	inSubset := make(map[string]map[string]bool)
+	placed := make(map[string]map[string]bool)
+	for _, key := range selfKeys {
+		inSubset[key.Name] = make(map[string]bool)
+		placed[key.Name] = make(map[string]bool)
+		for _, row := range pending {
+			inSubset[key.Name][rowKey(row, key.ReferencedColumns)] = true
+		}
+	}
+
+	var ordered []subsetRow
+	for len(pending) > 0 {
+		var waiting []subsetRow
+		for _, row := range pending {
+			ready := true
+			for _, key := range selfKeys {
+				if len(keyValues([]subsetRow{row}, key.Columns)) == 0 {
+					continue // NULL, points at nothing
+				}
+				parent := rowKey(row, key.Columns)
+				if parent != rowKey(row, key.ReferencedColumns) && inSubset[key.Name][parent] && !placed[key.Name][parent] {
+					ready = false
+					break
+				}
+			}
+			if !ready {
+				waiting = append(waiting, row)
+				continue
+			}
+			ordered = append(ordered, row)
+			for _, key := range selfKeys {
+				placed[key.Name][rowKey(row, key.ReferencedColumns)] = true
+			}
+		}
+
+		if len(waiting) == len(pending) {
+			logger.Warning(fmt.Sprintf("'%s' has %d row(s) referencing each other in a cycle, inserting them as found.", node, len(waiting)))
+			return append(ordered, waiting...)
+		}
+		pending = waiting
+	}
+	return ordered
+}
+
+func quotedColumnNames(columns []ColumnDetails) string {
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = col.Name
+	}
+	return setup.QuoteNames(names)
+}
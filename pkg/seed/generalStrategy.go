@@ -3,11 +3,13 @@ package seed
 import (
 	"database/sql"
 	"fmt"
+	"math"
 	"strings"
 	"time"
 
 	"github.com/brianvoe/gofakeit/v6"
 	"github.com/jlammilliman/dbManager/pkg/logger"
+	"github.com/jlammilliman/dbManager/pkg/setup"
 )
 
 /*
@@ -18,24 +20,42 @@ import (
 */
 
 type ColumnDetails struct {
-	Name             string
-	Type             string
-	IsPrimaryKey     bool
-	ReferencedTable  string
-	ReferencedColumn string
-	ColumnSize       int
-	ColumnDefault    string // This helps us grab identities, or default values so we can ignore columns or override a Pkey insert
+	Name          string
+	Type          string
+	IsPrimaryKey  bool
+	ColumnSize    int // -1 represents (max)
+	Precision     int
+	Scale         int
+	ColumnDefault string // This helps us grab default values so we can ignore columns or override a Pkey insert
+	IsNullable    bool
+	IsIdentity    bool
+	IsComputed    bool
+	Collation     string
+	IsRowVersion  bool
+}
+
+// A foreign key constraint. Columns and ReferencedColumns are paired up by position
+type ForeignKeyDetails struct {
+	Name              string
+	ReferencedSchema  string
+	ReferencedTable   string
+	Columns           []string
+	ReferencedColumns []string
 }
 
 type TableDetails struct {
-	TableName string
-	Columns   []ColumnDetails
-	NumSeeds  int
+	SchemaName  string
+	TableName   string
+	Columns     []ColumnDetails
+	ForeignKeys []ForeignKeyDetails
+	NumSeeds    int
 }
 
 func CallGeneralStrategy(db *sql.DB, tableDetails TableDetails) error {
 	gofakeit.Seed(0) // Initialize gofakeit
 
+	tableName := setup.QuoteQualifiedName(tableDetails.SchemaName, tableDetails.TableName)
+
 	// Not the most efficient way, but this is a local database seed script sooooo.....
 	for i := 0; i < tableDetails.NumSeeds; i++ {
 		columnNames := []string{}
@@ -44,18 +64,31 @@ func CallGeneralStrategy(db *sql.DB, tableDetails TableDetails) error {
 
 		paramCounter := 1
 
+		// Every column of a foreign key has to come from the same parent row, so pick those up front
+		fkValues, err := pickForeignKeyValues(db, tableDetails)
+		if err != nil {
+			return err
+		}
+
 		for _, col := range tableDetails.Columns {
-			// Exclude primary keys. Include primary keys that are foreign keys, include primary keys without an identity
-			if (col.ReferencedTable == "" || col.ReferencedColumn == "" || col.ColumnDefault != "") && col.IsPrimaryKey {
+			// SQL Server generates these for us, and refuses explicit values for them
+			if col.IsIdentity || col.IsComputed || col.IsRowVersion {
 				continue
-			} else {
-				// If we escaped the above continue, we have a primary key without an identity
-				// Meaning we need to propogate the primary key...
+			}
+
+			fkValue, isForeignKey := fkValues[col.Name]
+			if col.IsPrimaryKey && !isForeignKey {
+				// Primary keys with a default (ie: NEWID()) fill themselves
+				if col.ColumnDefault != "" {
+					continue
+				}
+
+				// Otherwise we have a primary key without an identity, meaning we need to propogate the primary key...
 				logger.Debug(fmt.Sprintf("Primary Key '%s', Type: '%s', does not have an identity.", col.Name, col.Type))
-				if col.Type == "int" {
+				if isIntegerType(col.Type) {
 					// Fetch the maximum value of the primary key from the database and increment it
-					var maxID int
-					maxQuery := fmt.Sprintf("SELECT MAX(%s) FROM %s", col.Name, tableDetails.TableName)
+					var maxID int64
+					maxQuery := fmt.Sprintf("SELECT ISNULL(MAX(%s), 0) FROM %s", setup.QuoteName(col.Name), tableName)
 					err := db.QueryRow(maxQuery).Scan(&maxID)
 					if err != nil && err != sql.ErrNoRows {
 						return err
@@ -71,33 +104,31 @@ func CallGeneralStrategy(db *sql.DB, tableDetails TableDetails) error {
 			}
 			columnNames = append(columnNames, col.Name)
 
-			// If we are a foreign key, grab a suitable value
-			if col.ReferencedTable != "" {
-				// Fetch a random foreign key from the referenced table
-
-				// We can assign this to default user, since the seed script should ONLY be used in local dev....
-				if col.Name == "createdBy" || col.Name == "updatedBy" {
-					values = append(values, 1) // Seeder should only ever be used locally, 1 is (usually) default admin account
-				} else {
-					query := fmt.Sprintf("SELECT TOP 1 %s FROM %s ORDER BY NEWID()", col.ReferencedColumn, col.ReferencedTable)
-					row := db.QueryRow(query)
-					var fkValue int
-					if err := row.Scan(&fkValue); err != nil {
-						return err
-					}
-					values = append(values, fkValue)
-				}
+			// If we are a foreign key, use the value from the parent row we picked
+			if isForeignKey {
+				values = append(values, fkValue)
 			} else {
 				// Use type-based logic to generate some garbage
 				logger.Debug(fmt.Sprintf("Matching Column: '%s', Type: '%s'", col.Name, col.Type))
 				switch strings.ToLower(col.Type) {
-				case "bigint", "int", "smallint", "tinyint":
+				case "bigint", "int", "smallint":
 					values = append(values, gofakeit.Number(0, 10000))
 
+				case "tinyint":
+					values = append(values, gofakeit.Number(0, 255))
+
 				case "bit":
 					values = append(values, gofakeit.Bool())
 
-				case "decimal", "numeric", "money", "smallmoney":
+				case "decimal", "numeric":
+					// Stay within the integer digits the column allows, ie: decimal(5,2) tops out at 999.99
+					upperBound := 10000.0
+					if col.Precision > 0 && col.Precision-col.Scale < 4 {
+						upperBound = math.Pow10(col.Precision-col.Scale) - 1
+					}
+					values = append(values, math.Round(gofakeit.Float64Range(0, upperBound)*math.Pow10(col.Scale))/math.Pow10(col.Scale))
+
+				case "money", "smallmoney":
 					values = append(values, gofakeit.Float32Range(0, 10000))
 
 				case "float":
@@ -119,13 +150,13 @@ func CallGeneralStrategy(db *sql.DB, tableDetails TableDetails) error {
 					values = append(values, gofakeit.Date().Format("15:04:05"))
 
 				case "char", "varchar", "text":
-					values = append(values, gofakeit.Sentence(5))
+					values = append(values, fitToColumn(gofakeit.Sentence(5), col.ColumnSize))
 
 				case "nchar", "nvarchar", "ntext":
-					values = append(values, gofakeit.Sentence(5))
+					values = append(values, fitToColumn(gofakeit.Sentence(5), col.ColumnSize))
 
 				case "binary", "varbinary":
-					values = append(values, gofakeit.City()) // Just dump something in there
+					values = append(values, []byte(fitToColumn(gofakeit.City(), col.ColumnSize))) // Just dump something in there
 
 				case "image":
 					values = append(values, gofakeit.ImageURL(100, 100))
@@ -162,7 +193,7 @@ func CallGeneralStrategy(db *sql.DB, tableDetails TableDetails) error {
 
 				// Specialized String Types
 				case "sysname":
-					values = append(values, gofakeit.Username())
+					values = append(values, fitToColumn(gofakeit.Username(), 128))
 
 				default:
 					logger.Error(fmt.Sprintf("UNHANDLED TYPE: Column: '%s', Type: '%s'", col.Name, strings.ToLower(col.Type)))
@@ -176,16 +207,16 @@ func CallGeneralStrategy(db *sql.DB, tableDetails TableDetails) error {
 
 		// Handle the case where we filtered out all columns (SomEhOw)
 		if len(values) == 0 {
-			logger.Info(fmt.Sprintf("SKIPPED SEEDING ON '%s'. No Values were generated!\n", tableDetails.TableName))
+			logger.Info(fmt.Sprintf("SKIPPED SEEDING ON '%s'. No Values were generated!\n", tableName))
 		} else {
 			query := fmt.Sprintf(
 				"INSERT INTO %s (%s) VALUES (%s)",
-				tableDetails.TableName,
-				strings.Join(columnNames, ", "),
+				tableName,
+				setup.QuoteNames(columnNames),
 				strings.Join(valueHolders, ", "),
 			)
 
-			logger.Debug(fmt.Sprintf("Generated Query for '%s':\n  [QUERY]: %s", tableDetails.TableName, query))
+			logger.Debug(fmt.Sprintf("Generated Query for '%s':\n  [QUERY]: %s", tableName, query))
 			logger.PrintDivide(true)
 			logger.Debug(fmt.Sprintf(" [VALUES]: %v", values))
 			logger.PrintDivide(true)
@@ -196,7 +227,72 @@ func CallGeneralStrategy(db *sql.DB, tableDetails TableDetails) error {
 			}
 		}
 	}
-	logger.Info(fmt.Sprintf("SEEDED: '%s' %d times.", tableDetails.TableName, tableDetails.NumSeeds))
+	logger.Info(fmt.Sprintf("SEEDED: '%s' %d times.", tableName, tableDetails.NumSeeds))
 
 	return nil
 }
+
+// Picks a random parent row for each foreign key on the table, and returns the values keyed by column name
+func pickForeignKeyValues(db *sql.DB, tableDetails TableDetails) (map[string]interface{}, error) {
+	fkValues := make(map[string]interface{})
+
+	nullable := make(map[string]bool)
+	for _, col := range tableDetails.Columns {
+		nullable[col.Name] = col.IsNullable
+	}
+
+	for _, key := range tableDetails.ForeignKeys {
+		// We can assign this to default user, since the seed script should ONLY be used in local dev....
+		if len(key.Columns) == 1 && (key.Columns[0] == "createdBy" || key.Columns[0] == "updatedBy") {
+			fkValues[key.Columns[0]] = 1 // Seeder should only ever be used locally, 1 is (usually) default admin account
+			continue
+		}
+
+		// Fetch a random parent row from the referenced table
+		referencedTable := setup.QuoteQualifiedName(key.ReferencedSchema, key.ReferencedTable)
+		query := fmt.Sprintf("SELECT TOP 1 %s FROM %s ORDER BY NEWID()", setup.QuoteNames(key.ReferencedColumns), referencedTable)
+		row := make([]interface{}, len(key.ReferencedColumns))
+		rowPointers := make([]interface{}, len(row))
+		for i := range row {
+			rowPointers[i] = &row[i]
+		}
+
+		err := db.QueryRow(query).Scan(rowPointers...)
+		if err == sql.ErrNoRows {
+			// Nothing to point at yet, which is only fine if we're allowed to point at nothing
+			for _, column := range key.Columns {
+				if !nullable[column] {
+					return nil, fmt.Errorf("'%s' requires a row in '%s', which has no data", key.Name, referencedTable)
+				}
+			}
+		} else if err != nil {
+			return nil, err
+		}
+
+		for i, column := range key.Columns {
+			// A column shared by two keys keeps the first value it was given
+			if _, exists := fkValues[column]; !exists {
+				fkValues[column] = row[i]
+			}
+		}
+	}
+
+	return fkValues, nil
+}
+
+// Checks if a SQL type is one of the integer types
+func isIntegerType(dataType string) bool {
+	switch strings.ToLower(dataType) {
+	case "bigint", "int", "smallint", "tinyint":
+		return true
+	}
+	return false
+}
+
+// Trims generated text to the column's size limit so inserts don't fail on truncation. -1 and 0 mean no limit
+func fitToColumn(value string, size int) string {
+	if size > 0 && len(value) > size {
+		return value[:size]
+	}
+	return value
+}
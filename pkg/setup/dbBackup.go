@@ -0,0 +1,221 @@
+package setup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/jlammilliman/dbManager/pkg/config"
+	"github.com/jlammilliman/dbManager/pkg/logger"
+	"github.com/jlammilliman/dbManager/pkg/readiness"
+)
+
+// Backups capture a set up (and seeded) target, so getting back to a clean state is a restore instead of a full setup.
+// They're written by the server itself, into the container's data volume, so they live and die with the container.
+// Which backups exist is read back from the server's own backup history in msdb.
+
+// Where backups go on the server, inside the volume the generated compose file mounts at /var/opt/mssql
+var backupDir = "/var/opt/mssql/backup"
+
+// Backup names end up in file names, so they're kept to something safe
+var backupNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+type BackupInfo struct {
+	Name        string
+	Description string // The snapshot the target was set up from
+	Path        string // On the server
+	TakenAt     time.Time
+}
+
+// Where a backup of the target lives on the server, ie: /var/opt/mssql/backup/sei_api_test__seeded.bak
+func backupPath(database, name string) string {
+	return path.Join(backupDir, fmt.Sprintf("%s__%s.bak", database, name))
+}
+
+// The target's server, logged into master as the admin
+func openMaster(config *config.Config) (*sql.DB, error) {
+	master := targetAsAdmin(config)
+	master.Name = "master"
+	return openDatabase(master)
+}
+
+// Describes the snapshot the target was set up from, so a backup can be matched back to it
+func snapshotDescription(database string) string {
+	manifest, err := readManifest(filepath.Join("databases", database))
+	if err != nil {
+		return "No snapshot"
+	}
+	return fmt.Sprintf("Snapshot of %s from %s, generated %s", manifest.SourceDatabase, manifest.SourceHost, manifest.GeneratedAt.UTC().Format(time.RFC3339))
+}
+
+// Takes a full backup of the target under name, replacing any earlier backup with the same name.
+// Returns false if anything went wrong.
+func Backup(config *config.Config, name string) bool {
+	database := config.TargetDB.Name
+	if !backupNamePattern.MatchString(name) {
+		logger.Error(fmt.Sprintf("'%s' isn't a valid backup name, stick to letters, digits, '-' and '_'.", name))
+		return false
+	}
+
+	db, err := openMaster(config)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to connect to target '%s': %v", database, err))
+		return false
+	}
+	defer db.Close()
+
+	// BACKUP won't create the directory itself
+	if _, err := db.Exec("EXEC master.sys.xp_create_subdir @p1;", backupDir); err != nil {
+		logger.Error(fmt.Sprintf("Failed to create '%s' on the server: %v", backupDir, err))
+		return false
+	}
+
+	file := backupPath(database, name)
+	logger.Debug(fmt.Sprintf("Backing up '%s' to '%s'...", database, file))
+	start := time.Now()
+	// COPY_ONLY keeps these out of any real backup chain the server might have
+	query := fmt.Sprintf("BACKUP DATABASE %s TO DISK = N'%s' WITH COPY_ONLY, INIT, CHECKSUM, NAME = N'%s', DESCRIPTION = N'%s';",
+		QuoteName(database), escapeString(file), escapeString(name), escapeString(snapshotDescription(database)))
+	if _, err := db.Exec(query); err != nil {
+		logger.Error(fmt.Sprintf("Failed to back up '%s': %v", database, err))
+		return false
+	}
+
+	logger.Info(fmt.Sprintf("Backed up '%s' as '%s' in %v.", database, name, time.Since(start).Round(time.Millisecond)))
+	return true
+}
+
+// Looks up the target's backups, newest first. A name that was backed up more than once only shows its latest
+func getBackups(db *sql.DB, database string) ([]BackupInfo, error) {
+	rows, err := db.Query(`
+	SELECT bs.name, COALESCE(bs.description, ''), bmf.physical_device_name, bs.backup_finish_date
+	FROM msdb.dbo.backupset bs
+	JOIN msdb.dbo.backupmediafamily bmf ON bmf.media_set_id = bs.media_set_id
+	WHERE bs.database_name = @p1
+		AND bs.type = 'D'
+		AND bs.name IS NOT NULL
+		AND bmf.physical_device_name LIKE @p2
+	ORDER BY bs.backup_finish_date DESC
+	`, database, backupDir+"/%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var backups []BackupInfo
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var backup BackupInfo
+		if err := rows.Scan(&backup.Name, &backup.Description, &backup.Path, &backup.TakenAt); err != nil {
+			return nil, err
+		}
+		// Only backups this tool took, under their current name
+		if seen[backup.Name] || backup.Path != backupPath(database, backup.Name) {
+			continue
+		}
+		seen[backup.Name] = true
+		backups = append(backups, backup)
+	}
+	return backups, rows.Err()
+}
+
+// Lists the backups available for the target. Returns false if they couldn't be looked up.
+func ListBackups(config *config.Config) bool {
+	database := config.TargetDB.Name
+	db, err := openMaster(config)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to connect to target '%s': %v", database, err))
+		return false
+	}
+	defer db.Close()
+
+	backups, err := getBackups(db, database)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to look up backups: %v", err))
+		return false
+	}
+	if len(backups) == 0 {
+		logger.Info(fmt.Sprintf("No backups of '%s'. Take one with '--backup <name>'.", database))
+		return true
+	}
+
+	logger.Info(fmt.Sprintf("Backups of '%s':", database))
+	for _, backup := range backups {
+		logger.Message(fmt.Sprintf("  %-20s %s  %s", backup.Name, backup.TakenAt.Format("2006-01-02 15:04:05"), backup.Description))
+	}
+	return true
+}
+
+// Replaces the target with a backup taken by Backup. Anyone connected to the target is kicked off first.
+// Returns false if anything went wrong.
+func Restore(config *config.Config, name string) bool {
+	database := config.TargetDB.Name
+	db, err := openMaster(config)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to connect to target '%s': %v", database, err))
+		return false
+	}
+	defer db.Close()
+
+	backups, err := getBackups(db, database)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to look up backups: %v", err))
+		return false
+	}
+	var backup *BackupInfo
+	for i := range backups {
+		if backups[i].Name == name {
+			backup = &backups[i]
+		}
+	}
+	if backup == nil {
+		logger.Error(fmt.Sprintf("There is no backup of '%s' named '%s'. Run with '--backups' to see what there is.", database, name))
+		return false
+	}
+	logger.Debug(fmt.Sprintf("Restoring '%s' from %s (%s)...", database, backup.TakenAt.Format("2006-01-02 15:04:05"), backup.Description))
+
+	// Single user mode only holds on the connection that set it
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to connect to target '%s': %v", database, err))
+		return false
+	}
+	defer conn.Close()
+
+	var exists bool
+	if err := conn.QueryRowContext(context.Background(), "SELECT CAST(CASE WHEN DB_ID(@p1) IS NULL THEN 0 ELSE 1 END AS BIT)", database).Scan(&exists); err != nil {
+		logger.Error(fmt.Sprintf("Failed to look up database: %v", err))
+		return false
+	}
+	if exists {
+		if err := setSingleUser(conn, database); err != nil {
+			logger.Error(fmt.Sprintf("Failed to clear connections on '%s': %v", database, err))
+			return false
+		}
+	}
+
+	start := time.Now()
+	query := fmt.Sprintf("RESTORE DATABASE %s FROM DISK = N'%s' WITH REPLACE, CHECKSUM;", QuoteName(database), escapeString(backup.Path))
+	_, restoreErr := conn.ExecContext(context.Background(), query)
+
+	// The backup was taken in multi user mode, but a failed restore leaves the old database locked down
+	if _, err := conn.ExecContext(context.Background(), fmt.Sprintf("ALTER DATABASE %s SET MULTI_USER;", QuoteName(database))); err != nil && restoreErr == nil {
+		logger.Warning(fmt.Sprintf("Could not set '%s' back to MULTI_USER: %v", database, err))
+	}
+	if restoreErr != nil {
+		logger.Error(fmt.Sprintf("Failed to restore '%s': %v", database, restoreErr))
+		return false
+	}
+
+	if err := readiness.WaitForDatabase(config.ReadyTimeout, targetAsAdmin(config)); err != nil {
+		logger.Error(err.Error())
+		return false
+	}
+
+	logger.Info(fmt.Sprintf("Restored '%s' from '%s' in %v.", database, name, time.Since(start).Round(time.Millisecond)))
+	return true
+}
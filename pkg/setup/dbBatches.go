@@ -0,0 +1,151 @@
+package setup
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Splits scripts into batches the way sqlcmd and SSMS do. GO isn't T-SQL, it's a client side separator on a line of its own,
+// optionally followed by a count to run the batch that many times. Anything inside a string, quoted identifier,
+// or comment is never a separator.
+
+var batchSeparatorPattern = regexp.MustCompile(`(?i)^\s*GO(?:\s+(\d+))?\s*(?:--.*)?$`)
+
+// What the splitter is inside of at any point in a script
+type batchScanState int
+
+const (
+	scanCode batchScanState = iota
+	scanLineComment
+	scanBlockComment
+	scanString
+	scanQuotedIdentifier
+	scanBracketIdentifier
+)
+
+// Splits a script on its GO separators. Empty batches are dropped, and "GO n" repeats the batch before it n times
+func splitSQLBatches(script string) ([]string, error) {
+	var (
+		batches      []string
+		current      strings.Builder
+		state        = scanCode
+		commentDepth = 0 // Block comments nest in T-SQL
+	)
+
+	endBatch := func(count int) {
+		batch := strings.TrimSpace(current.String())
+		current.Reset()
+		if batch == "" {
+			return
+		}
+		for i := 0; i < count; i++ {
+			batches = append(batches, batch)
+		}
+	}
+
+	lines := strings.Split(strings.ReplaceAll(script, "\r\n", "\n"), "\n")
+	for _, line := range lines {
+		// Separators only count when they aren't part of something else
+		if state == scanCode {
+			if match := batchSeparatorPattern.FindStringSubmatch(line); match != nil {
+				count := 1
+				if match[1] != "" {
+					n, err := strconv.Atoi(match[1])
+					if err != nil || n < 1 {
+						return nil, fmt.Errorf("invalid batch count in '%s'", strings.TrimSpace(line))
+					}
+					count = n
+				}
+				endBatch(count)
+				continue
+			}
+		}
+
+		for i := 0; i < len(line); i++ {
+			c := line[i]
+			var next byte
+			if i+1 < len(line) {
+				next = line[i+1]
+			}
+
+			switch state {
+			case scanCode:
+				switch {
+				case c == '-' && next == '-':
+					state = scanLineComment
+					i++
+				case c == '/' && next == '*':
+					state = scanBlockComment
+					commentDepth = 1
+					i++
+				case c == '\'':
+					state = scanString
+				case c == '"':
+					state = scanQuotedIdentifier
+				case c == '[':
+					state = scanBracketIdentifier
+				}
+
+			case scanBlockComment:
+				if c == '/' && next == '*' {
+					commentDepth++
+					i++
+				} else if c == '*' && next == '/' {
+					commentDepth--
+					i++
+					if commentDepth == 0 {
+						state = scanCode
+					}
+				}
+
+			// Closing characters are escaped by doubling them up
+			case scanString:
+				if c == '\'' {
+					if next == '\'' {
+						i++
+					} else {
+						state = scanCode
+					}
+				}
+			case scanQuotedIdentifier:
+				if c == '"' {
+					if next == '"' {
+						i++
+					} else {
+						state = scanCode
+					}
+				}
+			case scanBracketIdentifier:
+				if c == ']' {
+					if next == ']' {
+						i++
+					} else {
+						state = scanCode
+					}
+				}
+			}
+		}
+
+		// Line comments end with the line
+		if state == scanLineComment {
+			state = scanCode
+		}
+
+		current.WriteString(line)
+		current.WriteString("\n")
+	}
+
+	switch state {
+	case scanBlockComment:
+		return nil, fmt.Errorf("unterminated block comment")
+	case scanString:
+		return nil, fmt.Errorf("unterminated string literal")
+	case scanQuotedIdentifier, scanBracketIdentifier:
+		return nil, fmt.Errorf("unterminated quoted identifier")
+	}
+
+	endBatch(1)
+	return batches, nil
+}
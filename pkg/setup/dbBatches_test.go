@@ -0,0 +1,129 @@
+package setup
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitSQLBatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		batches []string
+		wantErr bool
+	}{
+		{
+			name:    "single batch without a separator",
+			script:  "SELECT 1;",
+			batches: []string{"SELECT 1;"},
+		},
+		{
+			name:    "separator on its own line",
+			script:  "SELECT 1;\nGO\nSELECT 2;\ngo\n",
+			batches: []string{"SELECT 1;", "SELECT 2;"},
+		},
+		{
+			name:    "empty batches are dropped",
+			script:  "GO\n\nSELECT 1;\nGO\nGO\n",
+			batches: []string{"SELECT 1;"},
+		},
+		{
+			name:    "GO inside a string",
+			script:  "INSERT INTO t VALUES ('a\nGO\nb');\nGO\nSELECT 2;",
+			batches: []string{"INSERT INTO t VALUES ('a\nGO\nb');", "SELECT 2;"},
+		},
+		{
+			name:    "GO inside an escaped string",
+			script:  "SELECT 'it''s\nGO\n';\nGO",
+			batches: []string{"SELECT 'it''s\nGO\n';"},
+		},
+		{
+			name:    "GO inside a bracketed identifier",
+			script:  "CREATE TABLE [a\nGO\n]]b] (Id int);\nGO",
+			batches: []string{"CREATE TABLE [a\nGO\n]]b] (Id int);"},
+		},
+		{
+			name:    "GO inside a quoted identifier",
+			script:  "CREATE TABLE \"a\nGO\n\" (Id int);\nGO",
+			batches: []string{"CREATE TABLE \"a\nGO\n\" (Id int);"},
+		},
+		{
+			name:    "GO after a line comment",
+			script:  "SELECT 1; -- GO\n-- GO\nGO\nSELECT 2;",
+			batches: []string{"SELECT 1; -- GO\n-- GO", "SELECT 2;"},
+		},
+		{
+			name:    "line comment doesn't swallow a quote",
+			script:  "SELECT 1; -- don't\nGO\nSELECT 2;",
+			batches: []string{"SELECT 1; -- don't", "SELECT 2;"},
+		},
+		{
+			name:    "GO inside a block comment",
+			script:  "/*\nGO\n*/\nSELECT 1;\nGO",
+			batches: []string{"/*\nGO\n*/\nSELECT 1;"},
+		},
+		{
+			name:    "GO inside a nested block comment",
+			script:  "/* outer /* inner */\nGO\n*/\nSELECT 1;\nGO\nSELECT 2;",
+			batches: []string{"/* outer /* inner */\nGO\n*/\nSELECT 1;", "SELECT 2;"},
+		},
+		{
+			name:    "GO with a count repeats the batch",
+			script:  "INSERT INTO t DEFAULT VALUES;\nGO 3\nSELECT 1;",
+			batches: []string{"INSERT INTO t DEFAULT VALUES;", "INSERT INTO t DEFAULT VALUES;", "INSERT INTO t DEFAULT VALUES;", "SELECT 1;"},
+		},
+		{
+			name:    "GO with a zero count",
+			script:  "SELECT 1;\nGO 0",
+			wantErr: true,
+		},
+		{
+			name:    "GO followed by a comment",
+			script:  "SELECT 1;\n  GO -- end of the first batch\nSELECT 2;\nGO 2 -- twice",
+			batches: []string{"SELECT 1;", "SELECT 2;", "SELECT 2;"},
+		},
+		{
+			name:    "GO followed by anything else isn't a separator",
+			script:  "SELECT 1 AS GO\nGOTO Done;",
+			batches: []string{"SELECT 1 AS GO\nGOTO Done;"},
+		},
+		{
+			name:    "CRLF line endings",
+			script:  "SELECT 1;\r\nGO\r\nSELECT 2;\r\nGO 2\r\n",
+			batches: []string{"SELECT 1;", "SELECT 2;", "SELECT 2;"},
+		},
+		{
+			name:    "unterminated block comment",
+			script:  "/* /* */\nGO\nSELECT 1;",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated string",
+			script:  "SELECT 'oops;\nGO",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated bracketed identifier",
+			script:  "SELECT [oops;\nGO",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			batches, err := splitSQLBatches(test.script)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got batches %q", batches)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(batches, test.batches) {
+				t.Errorf("got %q, want %q", batches, test.batches)
+			}
+		})
+	}
+}
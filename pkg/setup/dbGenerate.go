@@ -3,10 +3,14 @@ package setup
 import (
 	"database/sql"
 	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	_ "github.com/denisenkom/go-mssqldb"
 	"github.com/jlammilliman/dbManager/pkg/config"
 	"github.com/jlammilliman/dbManager/pkg/logger"
+	"github.com/jlammilliman/dbManager/pkg/readiness"
 )
 
 // This handles the generation of a local sourceDatabase schema given a source sourceDatabase
@@ -18,17 +22,95 @@ var BlockedFromSeeding []string = []string{
 }
 
 type ColumnDetails struct {
-	Name             string
-	Type             string
-	IsPrimaryKey     bool
-	ReferencedTable  string
-	ReferencedColumn string
+	Name               string
+	Type               string
+	UserTypeSchema     string // Set when the column is declared with a user-defined alias type
+	UserTypeName       string
+	MaxLength          int // -1 represents (max)
+	Precision          int
+	Scale              int
+	DateTimePrecision  int
+	IsNullable         bool
+	IsIdentity         bool
+	IdentitySeed       int64
+	IdentityIncrement  int64
+	IsComputed         bool
+	ComputedDefinition string
+	IsPersisted        bool
+	Collation          string
+	IsRowVersion       bool
+	IsPrimaryKey       bool
+	DependsOnFunction  bool // Computed from a user defined function, so it can only be added once the modules exist
+}
+
+// A foreign key constraint. Columns and ReferencedColumns are paired up by position
+type ForeignKeyDetails struct {
+	Name              string
+	ReferencedSchema  string
+	ReferencedTable   string
+	Columns           []string
+	ReferencedColumns []string
+	OnDelete          string // NO_ACTION, CASCADE, SET_NULL, SET_DEFAULT
+	OnUpdate          string
+	IsNotTrusted      bool // Added WITH NOCHECK, so existing rows were never checked
+	IsDisabled        bool
+	DependsOnFunction bool // Sits on, or points at, a column computed from a user defined function
+}
+
+// A clustered or nonclustered index. Unique constraints are backed by an index, so they live here too
+type IndexDetails struct {
+	Name               string
+	IsClustered        bool
+	IsUnique           bool
+	IsUniqueConstraint bool
+	Columns            []IndexColumnDetails // Key columns, in key order
+	IncludedColumns    []string
+	FilterDefinition   string
+}
+
+type IndexColumnDetails struct {
+	Name         string
+	IsDescending bool
+}
+
+// A named CHECK or DEFAULT constraint. Column is only set for defaults, trust and disabled only apply to checks
+type ConstraintDetails struct {
+	Name              string
+	Column            string
+	Definition        string
+	IsNotTrusted      bool
+	IsDisabled        bool
+	DependsOnFunction bool // Calls a user defined function, directly or through a computed column
 }
 
 type TableDetails struct {
-	TableName string
-	Columns   []ColumnDetails
-	NumSeeds  int
+	SchemaName          string
+	TableName           string
+	PrimaryKeyName      string
+	PrimaryKeyColumns   []string // In key order, which isn't necessarily column order
+	PrimaryKeyClustered bool
+	Columns             []ColumnDetails
+	ForeignKeys         []ForeignKeyDetails
+	Indexes             []IndexDetails
+	CheckConstraints    []ConstraintDetails
+	DefaultConstraints  []ConstraintDetails
+	NumSeeds            int
+}
+
+// A view, function, or procedure scripted from sys.sql_modules
+type ModuleDetails struct {
+	ObjectType string // View, Function, or Procedure
+	SchemaName string
+	ObjectName string
+	Definition string
+	References []string // Schema qualified names of the objects this module uses
+}
+
+// Where each module type lives within a local generation
+var moduleDirs = map[string]string{
+	"View":      "views",
+	"Function":  "functions",
+	"Procedure": "procedures",
 }
 
 func Generate(config *config.Config, forceRefresh bool) {
@@ -45,12 +127,15 @@ func Generate(config *config.Config, forceRefresh bool) {
 		targetDatabase = config.TargetDB.Name
 	}
 
-	isDBConnected := isSQLServerContainerReady(server, port, username, password)
-	if !isDBConnected {
-		if config.UsingDocker {
-			logger.Warning("No active DB connection found. Checking for docker setup...")
-		}
-		logger.Error("No active DB connection found.")
+	if err := readiness.WaitForDatabase(config.ReadyTimeout, config.SourceDB); err != nil {
+		logger.Error(fmt.Sprintf("No active DB connection found: %v", err))
+		return
+	}
+
+	// Don't clobber an existing snapshot unless we were asked to
+	baseDir := filepath.Join("databases", targetDatabase)
+	if checkDirExists(baseDir) && !forceRefresh {
+		logger.Warning(fmt.Sprintf("Schema already exists at '%s'. If you'd like to regenerate it, run with '--force' or '-f'", baseDir))
 		return
 	}
 
@@ -59,6 +144,7 @@ func Generate(config *config.Config, forceRefresh bool) {
 	db, err := sql.Open("sqlserver", connString)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Failed to open sourceDatabase '%s': %v\n", sourceDatabase, err))
+		return
 	}
 	defer db.Close()
 
@@ -66,6 +152,7 @@ func Generate(config *config.Config, forceRefresh bool) {
 	tables, err := getTables(db, sourceDatabase)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Failed to get tables: %v", err))
+		return
 	}
 
 	// Call topography (returns a sorted priority seed list)
@@ -76,36 +163,271 @@ func Generate(config *config.Config, forceRefresh bool) {
 	}
 
 	// Create the .sql files for each table, view, procedure,
-	logger.Debug(fmt.Sprintf("Finished sorting tables. Generating schema at 'databases/%s'...", targetDatabase))
-	for _, table := range sortedTables {
-		logger.Debug(fmt.Sprintf("Table: %s", table.TableName))
+	logger.Debug(fmt.Sprintf("Finished sorting tables. Generating schema at '%s'...", baseDir))
+	err = createDatabaseDirs(targetDatabase)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to create schema directories: %v", err))
+		return
+	}
+
+	// Schemas have to exist before anything can be created inside of them
+	schemas, err := getSchemas(db)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to get schemas: %v", err))
+		return
+	}
+
+	schemasDir := filepath.Join(baseDir, "schemas")
+	for i, schema := range schemas {
+		fileName := fmt.Sprintf("%04d_%s.sql", i+1, schema)
+		err := writeSQLFile(filepath.Join(schemasDir, fileName), scriptSchema(schema))
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to script schema '%s': %v", schema, err))
+			return
+		}
+	}
+	logger.Info(fmt.Sprintf("Scripted %d schemas to '%s'.", len(schemas), schemasDir))
+
+	// User-defined types and sequences are used by tables, so they are scripted (and later run) ahead of them
+	types, err := getTypes(db)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to get user-defined types: %v", err))
+		return
+	}
+	var typeNames, typeScripts []string
+	for _, details := range types {
+		typeNames = append(typeNames, qualifiedName(details.SchemaName, details.TypeName))
+		typeScripts = append(typeScripts, scriptType(details))
+	}
+	if err := writeScripts(filepath.Join(baseDir, "types"), typeNames, typeScripts); err != nil {
+		logger.Error(fmt.Sprintf("Failed to script user-defined types: %v", err))
+		return
+	}
+
+	sequences, err := getSequences(db)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to get sequences: %v", err))
+		return
+	}
+	var sequenceNames, sequenceScripts []string
+	for _, sequence := range sequences {
+		sequenceNames = append(sequenceNames, qualifiedName(sequence.SchemaName, sequence.SequenceName))
+		sequenceScripts = append(sequenceScripts, scriptSequence(sequence))
+	}
+	if err := writeScripts(filepath.Join(baseDir, "sequences"), sequenceNames, sequenceScripts); err != nil {
+		logger.Error(fmt.Sprintf("Failed to script sequences: %v", err))
+		return
+	}
+
+	synonyms, err := getSynonyms(db)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to get synonyms: %v", err))
+		return
+	}
+	var synonymNames, synonymScripts []string
+	for _, synonym := range synonyms {
+		synonymNames = append(synonymNames, qualifiedName(synonym.SchemaName, synonym.SynonymName))
+		synonymScripts = append(synonymScripts, scriptSynonym(synonym))
+	}
+	if err := writeScripts(filepath.Join(baseDir, "synonyms"), synonymNames, synonymScripts); err != nil {
+		logger.Error(fmt.Sprintf("Failed to script synonyms: %v", err))
+		return
+	}
+	logger.Info(fmt.Sprintf("Scripted %d types, %d sequences, and %d synonyms to '%s'.", len(types), len(sequences), len(synonyms), baseDir))
+
+	// Prefix each script with its position in the sort so a directory listing replays them in a safe order
+	tablesDir := filepath.Join(baseDir, "tables")
+	for i, table := range sortedTables {
+		fileName := fmt.Sprintf("%04d_%s.%s.sql", i+1, table.SchemaName, table.TableName)
+		err := writeSQLFile(filepath.Join(tablesDir, fileName), scriptTable(table))
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to script table '%s.%s': %v", table.SchemaName, table.TableName, err))
+			return
+		}
+		logger.Debug(fmt.Sprintf("Scripted table: %s", fileName))
+
+		// Columns computed from a function are added once the modules exist, which puts them at the end of the table
+		trailing := true
+		for i := len(table.Columns) - 1; i >= 0; i-- {
+			if !table.Columns[i].DependsOnFunction {
+				trailing = false
+			} else if !trailing {
+				logger.Warning(fmt.Sprintf("Table '%s.%s' has columns computed from a function ahead of other columns. They'll be added after the table is created, so they end up last.", table.SchemaName, table.TableName))
+				break
+			}
+		}
+
+		// Indexes and constraints get their own phase, so they can be applied once every table exists.
+		// Foreign keys come after those, since they can reference a unique constraint instead of a primary key
+		constraints := scriptConstraints(table)
+		if constraints != "" {
+			err := writeSQLFile(filepath.Join(baseDir, "constraints", fileName), constraints)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Failed to script constraints for '%s.%s': %v", table.SchemaName, table.TableName, err))
+				return
+			}
+		}
+		foreignKeys := scriptForeignKeys(table)
+		if foreignKeys != "" {
+			err := writeSQLFile(filepath.Join(baseDir, "foreignKeys", fileName), foreignKeys)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Failed to script foreign keys for '%s.%s': %v", table.SchemaName, table.TableName, err))
+				return
+			}
+		}
+	}
+	logger.Info(fmt.Sprintf("Scripted %d tables to '%s'.", len(sortedTables), tablesDir))
+
+	// Fetch views, functions, and procedures from DB
+	modules, err := getSchema(db, sourceDatabase)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to get views, functions, and procedures: %v", err))
+		return
 	}
+
+	sortedModules, err := sortModules(modules)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Error Sorting: %v\n", err))
+		return
+	}
+
+	// Numbering is shared across every module directory, so the prefix reflects the position in the dependency graph
+	for i, module := range sortedModules {
+		fileName := fmt.Sprintf("%04d_%s.%s.sql", i+1, module.SchemaName, module.ObjectName)
+		filePath := filepath.Join(baseDir, moduleDirs[module.ObjectType], fileName)
+		err := writeSQLFile(filePath, module.Definition)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to script %s '%s.%s': %v", module.ObjectType, module.SchemaName, module.ObjectName, err))
+			return
+		}
+		logger.Debug(fmt.Sprintf("Scripted %s: %s", module.ObjectType, filePath))
+	}
+	logger.Info(fmt.Sprintf("Scripted %d views, functions, and procedures to '%s'.", len(sortedModules), baseDir))
+
+	// Computed columns, constraints, and indexes that call a function can only go on once the functions exist
+	for i, table := range sortedTables {
+		dependents := scriptFunctionDependents(table)
+		if dependents == "" {
+			continue
+		}
+		fileName := fmt.Sprintf("%04d_%s.%s.sql", i+1, table.SchemaName, table.TableName)
+		err := writeSQLFile(filepath.Join(baseDir, "functionDependents", fileName), dependents)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to script function dependents for '%s.%s': %v", table.SchemaName, table.TableName, err))
+			return
+		}
+	}
+
+	// Triggers sit on top of tables (and views), so they go last
+	triggers, err := getTriggers(db)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to get triggers: %v", err))
+		return
+	}
+	var triggerNames, triggerScripts []string
+	for _, trigger := range triggers {
+		// Database level triggers don't belong to a schema
+		if trigger.SchemaName == "" {
+			triggerNames = append(triggerNames, trigger.TriggerName)
+		} else {
+			triggerNames = append(triggerNames, qualifiedName(trigger.SchemaName, trigger.TriggerName))
+		}
+
+		// CREATE TRIGGER has to be alone in its batch, so switching it off again gets a batch of its own
+		script := trigger.Definition
+		if trigger.IsDisabled {
+			script = strings.TrimRight(script, "\r\n\t ") + "\nGO\n\n" + scriptTriggerState(trigger, false) + "\n"
+		}
+		triggerScripts = append(triggerScripts, script)
+	}
+	if err := writeScripts(filepath.Join(baseDir, "triggers"), triggerNames, triggerScripts); err != nil {
+		logger.Error(fmt.Sprintf("Failed to script triggers: %v", err))
+		return
+	}
+	logger.Info(fmt.Sprintf("Scripted %d triggers to '%s'.", len(triggers), baseDir))
+
+	// Keep the structured schema too, so a target can be verified against the snapshot alone
+	snapshot := &DatabaseDetails{
+		Tables:    sortedTables,
+		Modules:   sortedModules,
+		Types:     types,
+		Sequences: sequences,
+		Synonyms:  synonyms,
+		Triggers:  triggers,
+	}
+	err = writeSchemaSnapshot(baseDir, snapshot)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to write schema snapshot: %v", err))
+		return
+	}
+
+	// Record what we generated, so setup can replay it in order and catch hand edits
+	serverVersion, err := getServerVersion(db)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to get server version: %v", err))
+		return
+	}
+
+	manifest, err := buildManifest(baseDir, fmt.Sprintf("%s:%s", server, port), sourceDatabase, serverVersion)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to build manifest: %v", err))
+		return
+	}
+
+	err = writeManifest(baseDir, manifest)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to write manifest: %v", err))
+		return
+	}
+	logger.Info(fmt.Sprintf("Wrote manifest for %d scripts to '%s'.", len(manifest.Scripts), filepath.Join(baseDir, manifestFileName)))
+}
+
+// Writes a set of scripts into one directory of a generation, prefixed so a directory listing keeps the given order
+func writeScripts(dir string, names []string, scripts []string) error {
+	for i, name := range names {
+		fileName := fmt.Sprintf("%04d_%s.sql", i+1, name)
+		if err := writeSQLFile(filepath.Join(dir, fileName), scripts[i]); err != nil {
+			return fmt.Errorf("'%s': %v", name, err)
+		}
+		logger.Debug(fmt.Sprintf("Scripted: %s", filepath.Join(dir, fileName)))
+	}
+	return nil
 }
 
-func getSchema(db *sql.DB, sourceDatabase string) ([]TableDetails, error) {
+// Query to get all views, functions, and procedures along with their definitions and what they reference
+func getSchema(db *sql.DB, sourceDatabase string) ([]ModuleDetails, error) {
 
 	query := `
 		SELECT 
 			CASE 
 				WHEN o.type = 'P' THEN 'Procedure'
-				WHEN o.type = 'FN' THEN 'Function'
+				WHEN o.type IN ('FN', 'IF', 'TF') THEN 'Function'
 				WHEN o.type = 'V' THEN 'View'
 			END AS ObjectType,
 			s.name AS SchemaName,
 			o.name AS ObjectName,
-			re.referenced_entity_name,
-			re.referenced_minor_name,
-			CASE 
-				WHEN re.referenced_minor_id = 0 THEN 'Object'
-				ELSE 'Column'
-			END AS ReferencedType
+			m.definition,
+			re.ReferencedSchema,
+			re.ReferencedEntity
 		FROM 
 			sys.objects o
 			INNER JOIN sys.schemas s ON o.schema_id = s.schema_id
 			INNER JOIN sys.sql_modules m ON o.object_id = m.object_id
-			CROSS APPLY sys.dm_sql_referenced_entities(s.name + '.' + o.name, 'OBJECT') re
+			-- Read from the catalog rather than dm_sql_referenced_entities, which throws on any module with a stale reference.
+			-- Unbound references (deferred name resolution) fall back to the name they were written with.
+			-- LEFT so that modules which reference nothing still come back
+			LEFT JOIN (
+				SELECT DISTINCT
+					d.referencing_id,
+					COALESCE(OBJECT_SCHEMA_NAME(d.referenced_id), d.referenced_schema_name) AS ReferencedSchema,
+					COALESCE(OBJECT_NAME(d.referenced_id), d.referenced_entity_name) AS ReferencedEntity
+				FROM sys.sql_expression_dependencies d
+				WHERE d.referenced_server_name IS NULL AND d.referenced_database_name IS NULL -- This database only
+			) re ON re.referencing_id = o.object_id
 		WHERE 
-			o.type IN ('P', 'FN', 'V')
+			o.type IN ('P', 'FN', 'IF', 'TF', 'V')
+			AND o.is_ms_shipped = 0
+		ORDER BY s.name, o.name
 	;`
 
 	rows, err := db.Query(query)
@@ -114,7 +436,82 @@ func getSchema(db *sql.DB, sourceDatabase string) ([]TableDetails, error) {
 	}
 	defer rows.Close()
 
-	return nil, nil
+	// One row comes back per reference, so fold them up per module
+	modulesMap := make(map[string]*ModuleDetails)
+	var keys []string
+	for rows.Next() {
+		var (
+			objectType       string
+			schemaName       string
+			objectName       string
+			definition       sql.NullString
+			referencedSchema sql.NullString
+			referencedEntity sql.NullString
+		)
+		err := rows.Scan(&objectType, &schemaName, &objectName, &definition, &referencedSchema, &referencedEntity)
+		if err != nil {
+			return nil, err
+		}
+
+		key := qualifiedName(schemaName, objectName)
+		if _, exists := modulesMap[key]; !exists {
+			modulesMap[key] = &ModuleDetails{
+				ObjectType: objectType,
+				SchemaName: schemaName,
+				ObjectName: objectName,
+				Definition: definition.String,
+			}
+			keys = append(keys, key)
+		}
+
+		// A reference without a schema can't be pinned to an object, so there is nothing to depend on
+		if referencedSchema.Valid && referencedEntity.Valid {
+			reference := qualifiedName(referencedSchema.String, referencedEntity.String)
+			if reference != key && !stringInSlice(reference, modulesMap[key].References) {
+				modulesMap[key].References = append(modulesMap[key].References, reference)
+			}
+		}
+	}
+
+	var modules []ModuleDetails
+	for _, key := range keys {
+		module := modulesMap[key]
+		// Encrypted modules don't expose a definition, there is nothing we can script
+		if module.Definition == "" {
+			logger.Warning(fmt.Sprintf("Skipping %s '%s': definition is not available (WITH ENCRYPTION?)", module.ObjectType, key))
+			continue
+		}
+		modules = append(modules, *module)
+	}
+
+	logger.Debug(fmt.Sprintf("Successfully retrieved %d programmable objects from '%s'.", len(modules), sourceDatabase))
+
+	return modules, nil
+}
+
+// Query to get every user defined schema. dbo (and the system schemas) come with every database
+func getSchemas(db *sql.DB) ([]string, error) {
+	query := `
+	SELECT s.name
+	FROM sys.schemas s
+	WHERE s.schema_id BETWEEN 5 AND 16383 -- 1-4 are dbo/guest/INFORMATION_SCHEMA/sys, 16384+ are fixed database roles
+	ORDER BY s.name
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schemas []string
+	for rows.Next() {
+		var schemaName string
+		if err := rows.Scan(&schemaName); err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, schemaName)
+	}
+	return schemas, nil
 }
 
 // Query to get all tables and their columns, contraints
@@ -125,41 +522,67 @@ func getTables(db *sql.DB, sourceDatabase string) ([]TableDetails, error) {
 	-- Generate temp tables to assist with the SQL side topographical sorting
 	WITH PrimaryKeys AS (
 		SELECT 
+			tc.TABLE_SCHEMA,
 			tc.TABLE_NAME,
-			kcu.COLUMN_NAME
+			tc.CONSTRAINT_NAME,
+			kcu.COLUMN_NAME,
+			kcu.ORDINAL_POSITION
 		FROM INFORMATION_SCHEMA.TABLE_CONSTRAINTS tc
 		JOIN INFORMATION_SCHEMA.KEY_COLUMN_USAGE kcu 
-			ON kcu.CONSTRAINT_NAME = tc.CONSTRAINT_NAME 
+			ON kcu.CONSTRAINT_SCHEMA = tc.CONSTRAINT_SCHEMA 
+			AND kcu.CONSTRAINT_NAME = tc.CONSTRAINT_NAME 
+			AND kcu.TABLE_NAME = tc.TABLE_NAME
 		WHERE tc.CONSTRAINT_TYPE = 'PRIMARY KEY'
-	),
-	ForeignKeys AS (
-		SELECT 
-			kcu.TABLE_NAME, 
-			kcu.COLUMN_NAME, 
-			rc1.UNIQUE_CONSTRAINT_NAME AS REFERENCED_CONSTRAINT_NAME,
-			kcu2.TABLE_NAME AS REFERENCED_TABLE_NAME,
-			kcu2.COLUMN_NAME AS REFERENCED_COLUMN_NAME
-		FROM INFORMATION_SCHEMA.KEY_COLUMN_USAGE kcu
-		JOIN INFORMATION_SCHEMA.REFERENTIAL_CONSTRAINTS rc1 
-			ON kcu.CONSTRAINT_NAME = rc1.CONSTRAINT_NAME
-		JOIN INFORMATION_SCHEMA.KEY_COLUMN_USAGE kcu2 
-			ON rc1.UNIQUE_CONSTRAINT_NAME = kcu2.CONSTRAINT_NAME
 	)
 	
 	SELECT 
+		c.TABLE_SCHEMA,
 		c.TABLE_NAME,
 		c.COLUMN_NAME,
 		c.DATA_TYPE,
+		COALESCE(c.CHARACTER_MAXIMUM_LENGTH, 0),
+		COALESCE(c.NUMERIC_PRECISION, 0),
+		COALESCE(c.NUMERIC_SCALE, 0),
+		COALESCE(c.DATETIME_PRECISION, 0),
+		c.IS_NULLABLE,
+		sc.is_identity,
+		CAST(COALESCE(ic.seed_value, 0) AS BIGINT),
+		CAST(COALESCE(ic.increment_value, 0) AS BIGINT),
+		sc.is_computed,
+		cc.definition,
+		COALESCE(cc.is_persisted, 0),
+		c.COLLATION_NAME,
+		COALESCE(c.DOMAIN_SCHEMA, ''), -- Alias types show up as domains
+		COALESCE(c.DOMAIN_NAME, ''),
 		CASE 
 			WHEN pk.COLUMN_NAME IS NOT NULL THEN 'YES'
 			ELSE 'NO'
 		END AS IS_PRIMARY_KEY,
-		fk.REFERENCED_TABLE_NAME,
-		fk.REFERENCED_COLUMN_NAME
+		pk.CONSTRAINT_NAME,
+		COALESCE(pk.ORDINAL_POSITION, 0),
+		-- Computed columns that call a user defined function can't be created until the function exists
+		CAST(CASE WHEN EXISTS (
+			SELECT 1
+			FROM sys.sql_expression_dependencies d
+			JOIN sys.objects o ON o.object_id = d.referenced_id
+			WHERE d.referencing_id = sc.object_id AND d.referencing_minor_id = sc.column_id
+				AND o.type IN ('FN', 'IF', 'TF', 'FS', 'FT')
+		) THEN 1 ELSE 0 END AS BIT)
 	FROM INFORMATION_SCHEMA.COLUMNS c
-		LEFT JOIN PrimaryKeys pk ON c.TABLE_NAME = pk.TABLE_NAME AND c.COLUMN_NAME = pk.COLUMN_NAME
-		LEFT JOIN ForeignKeys fk ON c.TABLE_NAME = fk.TABLE_NAME AND c.COLUMN_NAME = fk.COLUMN_NAME
-	WHERE c.TABLE_CATALOG = '` + sourceDatabase + `'
+		LEFT JOIN PrimaryKeys pk 
+			ON c.TABLE_SCHEMA = pk.TABLE_SCHEMA AND c.TABLE_NAME = pk.TABLE_NAME AND c.COLUMN_NAME = pk.COLUMN_NAME
+	JOIN INFORMATION_SCHEMA.TABLES t 
+		ON c.TABLE_SCHEMA = t.TABLE_SCHEMA AND c.TABLE_NAME = t.TABLE_NAME AND c.TABLE_CATALOG = t.TABLE_CATALOG
+	-- INFORMATION_SCHEMA has no idea about identities or computed columns, so pull those from the catalog views
+	JOIN sys.columns sc 
+		ON sc.object_id = OBJECT_ID(QUOTENAME(c.TABLE_SCHEMA) + '.' + QUOTENAME(c.TABLE_NAME)) AND sc.name = c.COLUMN_NAME
+	LEFT JOIN sys.identity_columns ic ON ic.object_id = sc.object_id AND ic.column_id = sc.column_id
+	LEFT JOIN sys.computed_columns cc ON cc.object_id = sc.object_id AND cc.column_id = sc.column_id
+	WHERE 
+		c.TABLE_CATALOG = '` + sourceDatabase + `'
+		AND t.TABLE_TYPE = 'BASE TABLE' -- Filter out views
+		AND NOT (c.TABLE_SCHEMA = '` + HistorySchemaName + `' AND c.TABLE_NAME IN ('` + HistoryTableName + `', '` + VersionTableName + `')) -- Setup's own bookkeeping
+	ORDER BY c.TABLE_SCHEMA, c.TABLE_NAME, c.ORDINAL_POSITION -- Keep columns in their declared order
 	`
 	rows, err := db.Query(query)
 	if err != nil {
@@ -171,31 +594,109 @@ func getTables(db *sql.DB, sourceDatabase string) ([]TableDetails, error) {
 	tablesMap := make(map[string]*TableDetails)
 	for rows.Next() {
 		var (
-			tableName        string
-			columnName       string
-			dataType         string
-			isPrimaryKeyStr  string
-			referencedTable  sql.NullString
-			referencedColumn sql.NullString
+			schemaName         string
+			tableName          string
+			columnName         string
+			dataType           string
+			maxLength          int
+			precision          int
+			scale              int
+			dateTimePrecision  int
+			isNullableStr      string
+			isIdentity         bool
+			identitySeed       int64
+			identityIncrement  int64
+			isComputed         bool
+			computedDefinition sql.NullString
+			isPersisted        bool
+			collation          sql.NullString
+			userTypeSchema     string
+			userTypeName       string
+			isPrimaryKeyStr    string
+			primaryKeyName     sql.NullString
+			primaryKeyOrdinal  int
+			dependsOnFunction  bool
 		)
-		err := rows.Scan(&tableName, &columnName, &dataType, &isPrimaryKeyStr, &referencedTable, &referencedColumn)
+		err := rows.Scan(&schemaName, &tableName, &columnName, &dataType, &maxLength, &precision, &scale, &dateTimePrecision, &isNullableStr,
+			&isIdentity, &identitySeed, &identityIncrement, &isComputed, &computedDefinition, &isPersisted, &collation,
+			&userTypeSchema, &userTypeName, &isPrimaryKeyStr, &primaryKeyName, &primaryKeyOrdinal, &dependsOnFunction)
 		if err != nil {
 			return nil, err
 		}
 
-		if _, exists := tablesMap[tableName]; !exists {
-			tablesMap[tableName] = &TableDetails{TableName: tableName}
+		// Table names are only unique within a schema
+		key := qualifiedName(schemaName, tableName)
+		if _, exists := tablesMap[key]; !exists {
+			tablesMap[key] = &TableDetails{SchemaName: schemaName, TableName: tableName}
+		}
+		if primaryKeyName.Valid {
+			table := tablesMap[key]
+			table.PrimaryKeyName = primaryKeyName.String
+
+			// Slot the column into its key position
+			for len(table.PrimaryKeyColumns) < primaryKeyOrdinal {
+				table.PrimaryKeyColumns = append(table.PrimaryKeyColumns, "")
+			}
+			table.PrimaryKeyColumns[primaryKeyOrdinal-1] = columnName
 		}
 
 		column := ColumnDetails{
-			Name:             columnName,
-			Type:             dataType,
-			IsPrimaryKey:     isPrimaryKeyStr == "YES",
-			ReferencedTable:  referencedTable.String,
-			ReferencedColumn: referencedColumn.String,
+			Name:               columnName,
+			Type:               dataType,
+			UserTypeSchema:     userTypeSchema,
+			UserTypeName:       userTypeName,
+			MaxLength:          maxLength,
+			Precision:          precision,
+			Scale:              scale,
+			DateTimePrecision:  dateTimePrecision,
+			IsNullable:         isNullableStr == "YES",
+			IsIdentity:         isIdentity,
+			IdentitySeed:       identitySeed,
+			IdentityIncrement:  identityIncrement,
+			IsComputed:         isComputed,
+			ComputedDefinition: computedDefinition.String,
+			IsPersisted:        isPersisted,
+			Collation:          collation.String,
+			IsRowVersion:       dataType == "timestamp" || dataType == "rowversion", // INFORMATION_SCHEMA still calls rowversion 'timestamp'
+			IsPrimaryKey:       isPrimaryKeyStr == "YES",
+			DependsOnFunction:  dependsOnFunction,
+		}
+
+		tablesMap[key].Columns = append(tablesMap[key].Columns, column)
+	}
+
+	// Foreign keys are constraints in their own right (and may span several columns), so they're looked up separately
+	foreignKeys, err := getForeignKeys(db)
+	if err != nil {
+		return nil, err
+	}
+	for key, keys := range foreignKeys {
+		if table, exists := tablesMap[key]; exists {
+			table.ForeignKeys = keys
+		}
+	}
+	for _, table := range tablesMap {
+		for i, key := range table.ForeignKeys {
+			referenced, exists := tablesMap[qualifiedName(key.ReferencedSchema, key.ReferencedTable)]
+			table.ForeignKeys[i].DependsOnFunction = columnsDependOnFunction(*table, key.Columns) ||
+				(exists && columnsDependOnFunction(*referenced, key.ReferencedColumns))
 		}
+	}
 
-		tablesMap[tableName].Columns = append(tablesMap[tableName].Columns, column)
+	// Same goes for indexes and named constraints
+	indexes, err := getIndexes(db, tablesMap)
+	if err != nil {
+		return nil, err
+	}
+	for key, tableIndexes := range indexes {
+		if table, exists := tablesMap[key]; exists {
+			table.Indexes = tableIndexes
+		}
+	}
+
+	err = getConstraints(db, tablesMap)
+	if err != nil {
+		return nil, err
 	}
 
 	// Recast to new object to avoid any overlapping/dead data. --> Old array gets garbage collected
@@ -209,6 +710,257 @@ func getTables(db *sql.DB, sourceDatabase string) ([]TableDetails, error) {
 	return tables, nil
 }
 
+// Query to get every foreign key constraint, keyed by the schema qualified table it lives on
+func getForeignKeys(db *sql.DB) (map[string][]ForeignKeyDetails, error) {
+	query := `
+	SELECT 
+		OBJECT_SCHEMA_NAME(fk.parent_object_id) AS TABLE_SCHEMA,
+		OBJECT_NAME(fk.parent_object_id) AS TABLE_NAME,
+		fk.name AS CONSTRAINT_NAME,
+		OBJECT_SCHEMA_NAME(fk.referenced_object_id) AS REFERENCED_TABLE_SCHEMA,
+		OBJECT_NAME(fk.referenced_object_id) AS REFERENCED_TABLE_NAME,
+		pc.name AS COLUMN_NAME,
+		rc.name AS REFERENCED_COLUMN_NAME,
+		fk.delete_referential_action_desc,
+		fk.update_referential_action_desc,
+		fk.is_not_trusted,
+		fk.is_disabled
+	FROM sys.foreign_keys fk
+	JOIN sys.foreign_key_columns fkc ON fkc.constraint_object_id = fk.object_id
+	JOIN sys.columns pc ON pc.object_id = fkc.parent_object_id AND pc.column_id = fkc.parent_column_id
+	JOIN sys.columns rc ON rc.object_id = fkc.referenced_object_id AND rc.column_id = fkc.referenced_column_id
+	ORDER BY TABLE_SCHEMA, TABLE_NAME, CONSTRAINT_NAME, fkc.constraint_column_id -- Keeps column pairs in key order
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	foreignKeys := make(map[string][]ForeignKeyDetails)
+	for rows.Next() {
+		var (
+			schemaName       string
+			tableName        string
+			constraintName   string
+			referencedSchema string
+			referencedTable  string
+			columnName       string
+			referencedColumn string
+			onDelete         string
+			onUpdate         string
+			isNotTrusted     bool
+			isDisabled       bool
+		)
+		err := rows.Scan(&schemaName, &tableName, &constraintName, &referencedSchema, &referencedTable,
+			&columnName, &referencedColumn, &onDelete, &onUpdate, &isNotTrusted, &isDisabled)
+		if err != nil {
+			return nil, err
+		}
+
+		// Rows come back grouped by constraint, so we only ever need to check the last key on the table
+		table := qualifiedName(schemaName, tableName)
+		keys := foreignKeys[table]
+		if len(keys) == 0 || keys[len(keys)-1].Name != constraintName {
+			keys = append(keys, ForeignKeyDetails{
+				Name:             constraintName,
+				ReferencedSchema: referencedSchema,
+				ReferencedTable:  referencedTable,
+				OnDelete:         onDelete,
+				OnUpdate:         onUpdate,
+				IsNotTrusted:     isNotTrusted,
+				IsDisabled:       isDisabled,
+			})
+		}
+		key := &keys[len(keys)-1]
+		key.Columns = append(key.Columns, columnName)
+		key.ReferencedColumns = append(key.ReferencedColumns, referencedColumn)
+		foreignKeys[table] = keys
+	}
+
+	return foreignKeys, nil
+}
+
+// Query to get every index that isn't a primary key, keyed by the schema qualified table it lives on.
+// Primary keys are scripted along with the table, so we only note whether they are clustered.
+func getIndexes(db *sql.DB, tablesMap map[string]*TableDetails) (map[string][]IndexDetails, error) {
+	query := `
+	SELECT 
+		s.name AS TABLE_SCHEMA,
+		t.name AS TABLE_NAME,
+		i.name AS INDEX_NAME,
+		CASE WHEN i.type = 1 THEN 1 ELSE 0 END AS IS_CLUSTERED,
+		CASE WHEN i.type IN (1, 2) THEN 1 ELSE 0 END AS IS_ROWSTORE,
+		i.type_desc,
+		i.is_unique,
+		i.is_unique_constraint,
+		i.is_primary_key,
+		COALESCE(i.filter_definition, ''),
+		c.name AS COLUMN_NAME,
+		ic.is_descending_key,
+		ic.is_included_column
+	FROM sys.indexes i
+	JOIN sys.tables t ON t.object_id = i.object_id
+	JOIN sys.schemas s ON s.schema_id = t.schema_id
+	JOIN sys.index_columns ic ON ic.object_id = i.object_id AND ic.index_id = i.index_id
+	JOIN sys.columns c ON c.object_id = ic.object_id AND c.column_id = ic.column_id
+	WHERE 
+		i.type > 0 -- Everything but the heap itself
+		AND t.is_ms_shipped = 0
+	ORDER BY s.name, t.name, i.name, ic.is_included_column, ic.key_ordinal, ic.index_column_id
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	indexes := make(map[string][]IndexDetails)
+	skipped := make(map[string]bool)
+	for rows.Next() {
+		var (
+			schemaName         string
+			tableName          string
+			indexName          string
+			isClustered        bool
+			isRowstore         bool
+			typeDescription    string
+			isUnique           bool
+			isUniqueConstraint bool
+			isPrimaryKey       bool
+			filterDefinition   string
+			columnName         string
+			isDescending       bool
+			isIncluded         bool
+		)
+		err := rows.Scan(&schemaName, &tableName, &indexName, &isClustered, &isRowstore, &typeDescription, &isUnique, &isUniqueConstraint, &isPrimaryKey,
+			&filterDefinition, &columnName, &isDescending, &isIncluded)
+		if err != nil {
+			return nil, err
+		}
+
+		table := qualifiedName(schemaName, tableName)
+
+		// Only rowstore indexes get scripted. Columnstore, XML, and spatial ones would otherwise vanish without a word
+		if !isRowstore {
+			if !skipped[qualifiedName(table, indexName)] {
+				logger.Warning(fmt.Sprintf("Skipping %s index '%s' on '%s', only clustered and nonclustered indexes are scripted.", typeDescription, indexName, table))
+				skipped[qualifiedName(table, indexName)] = true
+			}
+			continue
+		}
+
+		if isPrimaryKey {
+			if details, exists := tablesMap[table]; exists {
+				details.PrimaryKeyClustered = isClustered
+			}
+			continue
+		}
+
+		// Rows come back grouped by index, so we only ever need to check the last index on the table
+		tableIndexes := indexes[table]
+		if len(tableIndexes) == 0 || tableIndexes[len(tableIndexes)-1].Name != indexName {
+			tableIndexes = append(tableIndexes, IndexDetails{
+				Name:               indexName,
+				IsClustered:        isClustered,
+				IsUnique:           isUnique,
+				IsUniqueConstraint: isUniqueConstraint,
+				FilterDefinition:   filterDefinition,
+			})
+		}
+		index := &tableIndexes[len(tableIndexes)-1]
+		if isIncluded {
+			index.IncludedColumns = append(index.IncludedColumns, columnName)
+		} else {
+			index.Columns = append(index.Columns, IndexColumnDetails{Name: columnName, IsDescending: isDescending})
+		}
+		indexes[table] = tableIndexes
+	}
+
+	return indexes, nil
+}
+
+// Query to get every named CHECK and DEFAULT constraint, and attach them to their tables
+func getConstraints(db *sql.DB, tablesMap map[string]*TableDetails) error {
+	query := `
+	-- Anything that calls a user defined function directly
+	WITH FunctionCalls AS (
+		SELECT d.referencing_id, d.referencing_minor_id
+		FROM sys.sql_expression_dependencies d
+		JOIN sys.objects o ON o.object_id = d.referenced_id
+		WHERE o.type IN ('FN', 'IF', 'TF', 'FS', 'FT')
+	),
+	-- Plus anything that uses a computed column which does
+	FunctionDependents AS (
+		SELECT referencing_id FROM FunctionCalls
+		UNION
+		SELECT d.referencing_id
+		FROM sys.sql_expression_dependencies d
+		JOIN FunctionCalls fc ON fc.referencing_id = d.referenced_id AND fc.referencing_minor_id = d.referenced_minor_id
+		WHERE d.referenced_minor_id > 0
+	)
+
+	SELECT 
+		'CHECK' AS CONSTRAINT_TYPE,
+		OBJECT_SCHEMA_NAME(cc.parent_object_id),
+		OBJECT_NAME(cc.parent_object_id),
+		cc.name,
+		'' AS COLUMN_NAME,
+		cc.definition,
+		cc.is_not_trusted,
+		cc.is_disabled,
+		CAST(CASE WHEN cc.object_id IN (SELECT referencing_id FROM FunctionDependents) THEN 1 ELSE 0 END AS BIT)
+	FROM sys.check_constraints cc
+	WHERE cc.is_ms_shipped = 0
+	UNION ALL
+	SELECT 
+		'DEFAULT' AS CONSTRAINT_TYPE,
+		OBJECT_SCHEMA_NAME(dc.parent_object_id),
+		OBJECT_NAME(dc.parent_object_id),
+		dc.name,
+		c.name AS COLUMN_NAME,
+		dc.definition,
+		CAST(0 AS BIT), -- Defaults can't be untrusted or disabled
+		CAST(0 AS BIT),
+		CAST(CASE WHEN dc.object_id IN (SELECT referencing_id FROM FunctionDependents) THEN 1 ELSE 0 END AS BIT)
+	FROM sys.default_constraints dc
+	JOIN sys.columns c ON c.object_id = dc.parent_object_id AND c.column_id = dc.parent_column_id
+	WHERE dc.is_ms_shipped = 0
+	ORDER BY 2, 3, 4
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			constraintType string
+			schemaName     string
+			tableName      string
+			constraint     ConstraintDetails
+		)
+		err := rows.Scan(&constraintType, &schemaName, &tableName, &constraint.Name, &constraint.Column, &constraint.Definition,
+			&constraint.IsNotTrusted, &constraint.IsDisabled, &constraint.DependsOnFunction)
+		if err != nil {
+			return err
+		}
+
+		table, exists := tablesMap[qualifiedName(schemaName, tableName)]
+		if !exists {
+			continue
+		}
+		if constraintType == "CHECK" {
+			table.CheckConstraints = append(table.CheckConstraints, constraint)
+		} else {
+			table.DefaultConstraints = append(table.DefaultConstraints, constraint)
+		}
+	}
+
+	return nil
+}
+
 /*
 	BEGIN sorting. It is more cost efficient to sort in golang than within SQL server
 	We use a topological sort to ensure the following:
@@ -216,9 +968,10 @@ func getTables(db *sql.DB, sourceDatabase string) ([]TableDetails, error) {
 		2) Tables that reference 1 or more tables via foreign key
 		   constraint are built after the tables they reference
 		3) Tables we specified to be removed from seeding, get removed from list
+	With allowCycles set, a reference that closes a cycle is ignored instead of failing the sort.
 */
 
-func topologicalSort(graph map[string][]string) ([]string, error) {
+func topologicalSort(graph map[string][]string, allowCycles bool) ([]string, error) {
 	var order []string
 	visited := make(map[string]bool)
 	tempStack := make(map[string]bool)
@@ -227,6 +980,10 @@ func topologicalSort(graph map[string][]string) ([]string, error) {
 	var visit func(string) error
 	visit = func(node string) error {
 		if tempStack[node] {
+			if allowCycles {
+				logger.Debug(fmt.Sprintf("Dependency cycle through '%s', ignoring the reference that closes it.", node))
+				return nil
+			}
 			return fmt.Errorf("cyclic dependency detected. This is indicative of bad DB design")
 		}
 		if !visited[node] {
@@ -243,7 +1000,14 @@ func topologicalSort(graph map[string][]string) ([]string, error) {
 		return nil
 	}
 
+	// Walk the graph in name order so regenerating an unchanged schema yields the same file order
+	var nodes []string
 	for table := range graph {
+		nodes = append(nodes, table)
+	}
+	sort.Strings(nodes)
+
+	for _, table := range nodes {
 		if !visited[table] {
 			if err := visit(table); err != nil {
 				return nil, err
@@ -254,6 +1018,11 @@ func topologicalSort(graph map[string][]string) ([]string, error) {
 	return order, nil
 }
 
+// Builds the schema.name key we use to identify tables and modules across schemas
+func qualifiedName(schemaName, objectName string) string {
+	return schemaName + "." + objectName
+}
+
 // Checks for existence of a string in a given array
 func stringInSlice(a string, list []string) bool {
 	for _, b := range list {
@@ -269,14 +1038,22 @@ func sortTables(tables []TableDetails) ([]TableDetails, error) {
 	graph := make(map[string][]string)
 
 	for _, table := range tables {
-		for _, col := range table.Columns {
-			if col.ReferencedTable != "" {
-				graph[table.TableName] = append(graph[table.TableName], col.ReferencedTable)
+		// Every table is a node, even if nothing references it and it references nothing
+		node := qualifiedName(table.SchemaName, table.TableName)
+		graph[node] = []string{}
+		for _, key := range table.ForeignKeys {
+			// Self references are satisfied by the table itself, and would otherwise read as a cycle
+			dependency := qualifiedName(key.ReferencedSchema, key.ReferencedTable)
+			if dependency != node && !stringInSlice(dependency, graph[node]) {
+				graph[node] = append(graph[node], dependency)
 			}
 		}
+		sort.Strings(graph[node])
 	}
 
-	order, err := topologicalSort(graph)
+	// Foreign keys are added once every table exists, so a cycle between tables (ie: Department.ManagerId and
+	// Employee.DepartmentId) is fine, any order will do for the tables in it
+	order, err := topologicalSort(graph, true)
 	if err != nil {
 		return nil, err
 	}
@@ -285,12 +1062,13 @@ func sortTables(tables []TableDetails) ([]TableDetails, error) {
 	var sortedTables []TableDetails
 	for _, tableName := range order {
 		for _, table := range tables {
-			if table.TableName == tableName {
-				isBlocked := stringInSlice(table.TableName, BlockedFromSeeding)
+			if qualifiedName(table.SchemaName, table.TableName) == tableName {
+				// Blocked tables still need to be generated, they just don't get seeded
+				isBlocked := stringInSlice(table.TableName, BlockedFromSeeding) || stringInSlice(tableName, BlockedFromSeeding)
 				if !isBlocked {
 					table.NumSeeds = 3 // Default number of values to seed for the table
-					sortedTables = append(sortedTables, table)
 				}
+				sortedTables = append(sortedTables, table)
 				break
 			}
 		}
@@ -298,3 +1076,42 @@ func sortTables(tables []TableDetails) ([]TableDetails, error) {
 
 	return sortedTables, nil
 }
+
+// Creates a graph of module dependencies, and returns an ordered list in which it is safe to create them
+func sortModules(modules []ModuleDetails) ([]ModuleDetails, error) {
+	graph := make(map[string][]string)
+	modulesMap := make(map[string]ModuleDetails)
+
+	for _, module := range modules {
+		key := qualifiedName(module.SchemaName, module.ObjectName)
+		modulesMap[key] = module
+	}
+
+	for key, module := range modulesMap {
+		graph[key] = []string{}
+
+		// Only other modules matter here, tables are always created first.
+		// Procedures are ordered the same way, so a procedure calling another is created after it and doesn't lean on retries
+		for _, reference := range module.References {
+			if _, isModule := modulesMap[reference]; isModule {
+				graph[key] = append(graph[key], reference)
+			}
+		}
+		sort.Strings(graph[key])
+	}
+
+	// Procedures can call each other in a circle, deferred name resolution lets them be created in any order within it
+	order, err := topologicalSort(graph, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var sortedModules []ModuleDetails
+	for _, key := range order {
+		if module, exists := modulesMap[key]; exists {
+			sortedModules = append(sortedModules, module)
+		}
+	}
+
+	return sortedModules, nil
+}
@@ -1,49 +1,18 @@
 package setup
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
-	"strings"
 	"os"
-	"os/exec"
 	"io/ioutil"
     "path/filepath"
 
+	"github.com/jlammilliman/dbManager/pkg/config"
 	"github.com/jlammilliman/dbManager/pkg/logger"
 	_ "github.com/denisenkom/go-mssqldb"
 )
 
-// ==========================
-// DOCKER Helpers
-// ==========================
-
-// Checks to see if the local docker container is running on the host machine
-func isContainerRunning(containerName string) bool {
-	cmd := exec.Command("docker", "inspect", "-f", "{{.State.Running}}", "/"+containerName)
-	output, err := cmd.Output()
-	log.Println(output)
-	if err != nil {
-		return false
-	}
-	return strings.TrimSpace(string(output)) == "true"
-}
-
-// If the SQLServer container has just started, it usually takes a minute or so to spin up depending on local hardware,
-// So we wait for it
-func isSQLServerContainerReady(server, port, username, password string) bool {
-	connString := fmt.Sprintf("server=%s;port=%s;user id=%s;password=%s;database=master", server, port, username, password)
-	db, err := sql.Open("sqlserver", connString)
-	if err != nil {
-		fmt.Println(err)
-		return false
-	}
-	defer db.Close()
-
-	err = db.Ping()
-	return err == nil
-}
-
 // ==========================
 // File Management Helpers
 // ==========================
@@ -56,12 +25,22 @@ func checkDirExists(path string) bool {
     return info.IsDir()
 }
 
+// Directories that make up a local generation, in the order setup applies them.
+// Types and sequences come before the tables that use them, triggers after the tables they sit on.
+// Foreign keys wait for the unique constraints they can reference, and anything computed from a function for the modules.
+var generatedDirs = []string{
+	"schemas", "types", "sequences", "synonyms", "tables", "constraints", "foreignKeys",
+	"functions", "views", "procedures", "functionDependents", "triggers",
+}
+
+// Everything but seedStrategies is rebuilt by Generate
+var databaseDirs = append(append([]string{}, generatedDirs...), "seedStrategies")
+
 // Sanity check for the required directories to exist in a local generation
 func checkDatabaseDirs(dbName string) error {
     baseDir := filepath.Join("databases", dbName)
-    subDirs := []string{"tables", "functions", "procedures", "views", "seedStrategies"}
 
-    for _, dir := range subDirs {
+    for _, dir := range databaseDirs {
         fullPath := filepath.Join(baseDir, dir)
         if !checkDirExists(fullPath) {
             return fmt.Errorf("directory not found: %s", fullPath)
@@ -70,6 +49,29 @@ func checkDatabaseDirs(dbName string) error {
     return nil
 }
 
+// Lays out the directories for a local generation, clearing out anything previously generated
+func createDatabaseDirs(dbName string) error {
+	baseDir := filepath.Join("databases", dbName)
+
+	for _, dir := range generatedDirs {
+		if err := os.RemoveAll(filepath.Join(baseDir, dir)); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range databaseDirs {
+		if err := os.MkdirAll(filepath.Join(baseDir, dir), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes a generated script to disk
+func writeSQLFile(path, content string) error {
+	return os.WriteFile(path, []byte(content), 0644)
+}
+
 // ListFiles lists all files in a given directory.
 func listFiles(directory string) ([]string, error) {
     var files []string
@@ -91,157 +93,204 @@ func listFiles(directory string) ([]string, error) {
 // MS SQL SERVER Helpers
 // ==========================
 
-func executeSQLFiles(server, port, username, password, database string, files []string) error {
-    for _, file := range files {
-        err := executeSQLFile(server, port, username, password, database, file)
-        if err != nil {
-            return err
-        }
-		logger.Debug(fmt.Sprintf("Executed '%v'", file))
-    }
+// Runs .sql files in order, recording each one in the schema history under its path within baseDir
+func executeSQLFiles(server, port, username, password, database, baseDir string, files []string) error {
+	// Establish a database connection
+	connString := fmt.Sprintf("server=%s;port=%s;user id=%s;password=%s;database=%s", server, port, username, password, database)
+	db, err := sql.Open("mssql", connString)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the database: %v", err)
+	}
+	defer db.Close()
+
+	// Batches share a session, the same as they would under sqlcmd
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to connect to the database: %v", err)
+	}
+	defer conn.Close()
+
+	if err := ensureHistoryTable(conn); err != nil {
+		return fmt.Errorf("failed to create schema history: %v", err)
+	}
+
+	for _, file := range files {
+		if err := applyScript(conn, baseDir, file); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// Spins up a database, optionally dropping it if it already exists
-func createDatabase(server, port, username, password, database string, forceRefresh bool) error {
+// Spins up a database, optionally dropping it if it already exists. Returns true if the database was created
+func createDatabase(server, port, username, password, database string, forceRefresh bool) (bool, error) {
 	connString := fmt.Sprintf("server=%s;port=%s;user id=%s;password=%s;database=master", server, port, username, password)
 	db, err := sql.Open("sqlserver", connString)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer db.Close()
 
-	checkDBQuery := fmt.Sprintf("SELECT name FROM sys.databases WHERE name = '%s'", database)
-	results, err := db.Query(checkDBQuery)
-	if err != nil {
+	var dbName string
+	err = db.QueryRow("SELECT name FROM sys.databases WHERE name = @p1", database).Scan(&dbName)
+	if err != nil && err != sql.ErrNoRows {
 		logger.Error(fmt.Sprintf("Failed to lookup database. Error: %v", err))
+		return false, err
 	}
 
-	for results.Next() {
-		var dbName string
-		err := results.Scan(&dbName)
-		if err != nil {
-			logger.Error(fmt.Sprintf("Error in Scan: %v", err))
+	if err == nil {
+		logger.Debug("Database already exists.")
+
+		if !forceRefresh {
+			// If you don't want to force-refresh, setup only applies what the schema history says is missing
+			logger.Debug(fmt.Sprintf("Database '%s' already exists, only new or changed scripts will be applied. If you'd like to force drop and repropogate, run with '--force' or '-f'", dbName))
+			return false, nil
+		}
+
+		logger.Warning(fmt.Sprintf("Force refresh is enabled. Dropping the database: %s.\n", database))
+		if err := dropDatabase(db, database); err != nil {
+			return false, err
 		}
+	}
 
-		if dbName == database {
-			logger.Debug("Database already exists.")
+	logger.Debug(fmt.Sprintf("Creating Database '%s'.", database))
+	createDBQuery := fmt.Sprintf("CREATE DATABASE %s;", QuoteName(database))
+	_, err = db.Exec(createDBQuery)
+	return err == nil, err
+}
 
-			if forceRefresh {
-				logger.Warning(fmt.Sprintf("Force refresh is enabled. Dropping the database: %s.\n", database))
+// The target, logged into as the admin. Anything that changes the schema, or reads module definitions, needs more
+// than the app login's read/write access
+func targetAsAdmin(config *config.Config) config.DB {
+	admin := config.TargetDB
+	admin.Username = config.Admin.Username
+	admin.Password = config.Admin.Password
+	return admin
+}
 
-				// Disconnect all users from the database
-				logger.Debug(fmt.Sprintf("Clearing connections on %s", database))
-				disconnectUsersQuery := fmt.Sprintf(`
-					USE master;
-					ALTER DATABASE [%s] SET SINGLE_USER WITH ROLLBACK IMMEDIATE;`, database)
-				_, err := db.Exec(disconnectUsersQuery)
-				if err != nil {
-					return err
-				}
+// Kicks everyone off of a database and drops it. db must be connected to master
+func dropDatabase(db *sql.DB, database string) error {
+	// Disconnect all users from the database
+	err := setSingleUser(db, database)
+	if err != nil {
+		return err
+	}
 
-				// Drop
-				dropDBQuery := fmt.Sprintf("DROP DATABASE %s;", database)
-				_, err = db.Exec(dropDBQuery)
-				if err != nil {
-					return err
-				}
-				logger.Info("Database dropped.")
-
-				// Reset multi-user connection setting
-				setMultiUserQuery := fmt.Sprintf("ALTER DATABASE [%s] SET MULTI_USER;", database)
-				_, err = db.Exec(setMultiUserQuery)
-				if err != nil {
-					// It's okay to ignore this error since we just dropped the database
-					logger.Info("Ignoring Error: Could not set database to MULTI_USER, which is expected since the database was just dropped.")
-				}
+	// Drop
+	dropDBQuery := fmt.Sprintf("DROP DATABASE %s;", QuoteName(database))
+	_, err = db.Exec(dropDBQuery)
+	if err != nil {
+		return err
+	}
+	logger.Info("Database dropped.")
 
-			} else {
-				// If you don't want to force-refresh, just return
-				logger.Debug(fmt.Sprintf("Database '%s' already exists. If you'd like to force drop and repropogate, run with '--force' or '-f'", dbName))
-				return nil
-			}
-		}
+	// Reset multi-user connection setting
+	setMultiUserQuery := fmt.Sprintf("ALTER DATABASE %s SET MULTI_USER;", QuoteName(database))
+	_, err = db.Exec(setMultiUserQuery)
+	if err != nil {
+		// It's okay to ignore this error since we just dropped the database
+		logger.Info("Ignoring Error: Could not set database to MULTI_USER, which is expected since the database was just dropped.")
 	}
+	return nil
+}
 
-	logger.Debug(fmt.Sprintf("Creating Database '%s'.", database))
-	createDBQuery := fmt.Sprintf("CREATE DATABASE %s;", database)
-	_, err = db.Exec(createDBQuery)
+// Kicks everyone off of a database, rolling back whatever they were in the middle of
+func setSingleUser(executor sqlExecutor, database string) error {
+	logger.Debug(fmt.Sprintf("Clearing connections on %s", database))
+	disconnectUsersQuery := fmt.Sprintf(`
+		USE master;
+		ALTER DATABASE %s SET SINGLE_USER WITH ROLLBACK IMMEDIATE;`, QuoteName(database))
+	_, err := executor.ExecContext(context.Background(), disconnectUsersQuery)
 	return err
 }
 
-// Helper function to handle running .sql files
-func executeSQLFile(server, port, username, password, database, filePath string) error {
+// Drops a database from its own connection to master, used to clean up after a failed setup
+func dropDatabaseOnServer(server, port, username, password, database string) error {
+	connString := fmt.Sprintf("server=%s;port=%s;user id=%s;password=%s;database=master", server, port, username, password)
+	db, err := sql.Open("sqlserver", connString)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return dropDatabase(db, database)
+}
+
+// Anything batches can be run on: a connection, or a transaction
+type sqlExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Runs a .sql file on an existing session
+func executeSQLFileOn(executor sqlExecutor, filePath string) error {
 	// Read the SQL file
 	content, err := os.ReadFile(filePath)
 	if err != nil {
 		return fmt.Errorf("failed to read SQL file: %v", err)
 	}
 
-	// Convert the content to string
-	sqlScript := string(content)
-
-	// Split the script into separate SQL statements
-	sqlStatements := strings.Split(sqlScript, ";")
-
-	// Establish a database connection
-	connString := fmt.Sprintf("server=%s;port=%s;user id=%s;password=%s;database=%s", server, port, username, password, database)
-	db, err := sql.Open("mssql", connString)
+	// Split the script into batches on its GO separators. Each batch is sent whole, so CREATE PROCEDURE and friends
+	// get to be the first statement in their batch, and semicolons inside of them are left alone
+	batches, err := splitSQLBatches(string(content))
 	if err != nil {
-		return fmt.Errorf("failed to connect to the database: %v", err)
+		return fmt.Errorf("failed to parse SQL file: %v", err)
 	}
-	defer db.Close()
 
-	// Execute each SQL statement
-	for _, statement := range sqlStatements {
-		statement = strings.TrimSpace(statement)
-		if statement != "" {
-			_, err = db.Exec(statement)
-			if err != nil {
-				return fmt.Errorf("failed to execute SQL statement: %v", err)
-			}
+	// Execute each batch
+	for i, batch := range batches {
+		_, err = executor.ExecContext(context.Background(), batch)
+		if err != nil {
+			return fmt.Errorf("failed to execute batch %d of %d in '%s': %v", i+1, len(batches), filePath, err)
 		}
 	}
 
 	return nil
 }
 
-func createReadWriteUser(server, port, username, password, database, userUsername, userPassword string) error {
-	// CREATE LOGIN statement
-	createLoginCmd := exec.Command("sqlcmd", "-S", fmt.Sprintf("%s,%s", server, port),
-		"-U", username, "-P", password, "-d", database,
-		"-Q", fmt.Sprintf("CREATE LOGIN %s WITH PASSWORD='%s';", userUsername, userPassword))
-	err := createLoginCmd.Run()
+// Runs every phase of a setup inside of a single transaction, history included. If anything fails, all of it is rolled back
+func executeSQLFilesInTransaction(server, port, username, password, database, baseDir string, phases []string, files map[string][]string) error {
+	connString := fmt.Sprintf("server=%s;port=%s;user id=%s;password=%s;database=%s", server, port, username, password, database)
+	db, err := sql.Open("mssql", connString)
 	if err != nil {
-		return fmt.Errorf("failed to create login: %v", err)
+		return fmt.Errorf("failed to connect to the database: %v", err)
 	}
+	defer db.Close()
 
-	// CREATE USER statement
-	createUserCmd := exec.Command("sqlcmd", "-S", fmt.Sprintf("%s,%s", server, port),
-		"-U", username, "-P", password, "-d", database,
-		"-Q", fmt.Sprintf("USE %s; CREATE USER %s FOR LOGIN %s;", database, userUsername, userUsername))
-	err = createUserCmd.Run()
+	conn, err := db.Conn(context.Background())
 	if err != nil {
-		return fmt.Errorf("failed to create user: %v", err)
+		return fmt.Errorf("failed to connect to the database: %v", err)
 	}
+	defer conn.Close()
 
-	// ADD MEMBER to db_datareader role
-	addReaderRoleCmd := exec.Command("sqlcmd", "-S", fmt.Sprintf("%s,%s", server, port),
-		"-U", username, "-P", password, "-d", database,
-		"-Q", fmt.Sprintf("USE %s; ALTER ROLE db_datareader ADD MEMBER %s;", database, userUsername))
-	err = addReaderRoleCmd.Run()
-	if err != nil {
-		return fmt.Errorf("failed to add user to db_datareader role: %v", err)
+	// Without XACT_ABORT some errors only fail the statement, and the transaction would carry on
+	if _, err := conn.ExecContext(context.Background(), "SET XACT_ABORT ON;"); err != nil {
+		return err
 	}
 
-	// ADD MEMBER to db_datawriter role
-	addWriterRoleCmd := exec.Command("sqlcmd", "-S", fmt.Sprintf("%s,%s", server, port),
-		"-U", username, "-P", password, "-d", database,
-		"-Q", fmt.Sprintf("USE %s; ALTER ROLE db_datawriter ADD MEMBER %s;", database, userUsername))
-	err = addWriterRoleCmd.Run()
+	tx, err := conn.BeginTx(context.Background(), nil)
 	if err != nil {
-		return fmt.Errorf("failed to add user to db_datawriter role: %v", err)
+		return fmt.Errorf("failed to start transaction: %v", err)
 	}
 
+	if err := ensureHistoryTable(tx); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to create schema history: %v", err)
+	}
+
+	for _, phase := range phases {
+		logger.Debug(fmt.Sprintf("Creating %s...", phase))
+		for _, file := range files[phase] {
+			if err := applyScript(tx, baseDir, file); err != nil {
+				if rollbackErr := tx.Rollback(); rollbackErr != nil && rollbackErr != sql.ErrTxDone {
+					return fmt.Errorf("failed to create %s: %v (and rollback failed: %v)", phase, err, rollbackErr)
+				}
+				return fmt.Errorf("failed to create %s, rolled back: %v", phase, err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %v", err)
+	}
 	return nil
-}
\ No newline at end of file
+}
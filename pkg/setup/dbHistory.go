@@ -0,0 +1,176 @@
+package setup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/jlammilliman/dbManager/pkg/logger"
+)
+
+// The schema history table records every script applied to a target, so setup can pick up where it left off
+// instead of starting over. Scripts are keyed by their path within the snapshot without the ordering prefix,
+// ie: tables/dbo.Users.sql, so regenerating a snapshot that renumbers its files doesn't make them look new
+
+// Lives in dbo on the target, along with the version table. Introspection and seeding skip both,
+// they're our bookkeeping and not part of the schema
+var HistorySchemaName = "dbo"
+var HistoryTableName = "__SchemaHistory"
+
+// Creates the history table if it isn't there yet
+func ensureHistoryTable(executor sqlExecutor) error {
+	query := fmt.Sprintf(`
+	IF OBJECT_ID(N'%s', N'U') IS NULL
+	CREATE TABLE %s (
+		[Id] INT IDENTITY(1,1) NOT NULL PRIMARY KEY,
+		[Script] NVARCHAR(400) NOT NULL,
+		[Checksum] CHAR(64) NOT NULL,
+		[DurationMs] BIGINT NOT NULL,
+		[AppliedAt] DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME(),
+		[AppliedBy] NVARCHAR(128) NOT NULL DEFAULT SUSER_SNAME(),
+		[Success] BIT NOT NULL
+	);`, escapeString(QuoteQualifiedName(HistorySchemaName, HistoryTableName)), QuoteQualifiedName(HistorySchemaName, HistoryTableName))
+
+	_, err := executor.ExecContext(context.Background(), query)
+	return err
+}
+
+// Looks up the checksum each script had the last time it was applied successfully
+func getAppliedScripts(server, port, username, password, database string) (map[string]string, error) {
+	connString := fmt.Sprintf("server=%s;port=%s;user id=%s;password=%s;database=%s", server, port, username, password, database)
+	db, err := sql.Open("sqlserver", connString)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if err := ensureHistoryTable(db); err != nil {
+		return nil, fmt.Errorf("failed to create schema history: %v", err)
+	}
+
+	query := fmt.Sprintf(`
+	SELECT h.[Script], h.[Checksum]
+	FROM %s h
+	WHERE h.[Id] IN (SELECT MAX([Id]) FROM %s WHERE [Success] = 1 GROUP BY [Script])
+	ORDER BY h.[Id]
+	`, QuoteQualifiedName(HistorySchemaName, HistoryTableName), QuoteQualifiedName(HistorySchemaName, HistoryTableName))
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[string]string)
+	for rows.Next() {
+		var script, checksum string
+		if err := rows.Scan(&script, &checksum); err != nil {
+			return nil, err
+		}
+		applied[historyKey(script)] = checksum
+	}
+	return applied, rows.Err()
+}
+
+// Records a single run of a script
+func recordScript(executor sqlExecutor, script, checksum string, duration time.Duration, success bool) error {
+	query := fmt.Sprintf("INSERT INTO %s ([Script], [Checksum], [DurationMs], [Success]) VALUES (@p1, @p2, @p3, @p4);",
+		QuoteQualifiedName(HistorySchemaName, HistoryTableName))
+	_, err := executor.ExecContext(context.Background(), query, script, checksum, duration.Milliseconds(), success)
+	return err
+}
+
+// The name a script is recorded under: its path within baseDir, or just the file name without one
+func historyScriptName(baseDir, file string) string {
+	if baseDir != "" {
+		if relativePath, err := filepath.Rel(baseDir, file); err == nil {
+			return historyKey(filepath.ToSlash(relativePath))
+		}
+	}
+	return historyKey(filepath.Base(file))
+}
+
+// Drops the ordering prefix from a recorded script name, ie: tables/0001_dbo.Users.sql -> tables/dbo.Users.sql.
+// Older histories were recorded with it
+func historyKey(script string) string {
+	dir, name := path.Split(script)
+	return dir + scriptPrefixPattern.ReplaceAllString(name, "")
+}
+
+// Runs a script and records it in the schema history, whether or not it worked
+func applyScript(executor sqlExecutor, baseDir, file string) error {
+	return applyScriptAs(executor, historyScriptName(baseDir, file), file)
+}
+
+// Runs a script and records it in the schema history under script, whether or not it worked
+func applyScriptAs(executor sqlExecutor, script, file string) error {
+	_, err := attemptScript(executor, script, file, true)
+	return err
+}
+
+// Runs a script, recording it in the schema history if it worked. Failures are only recorded with recordFailure set,
+// so a caller that retries can hold off until it gives up. Returns how long the run took
+func attemptScript(executor sqlExecutor, script, file string, recordFailure bool) (time.Duration, error) {
+	checksum, err := hashFile(file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read SQL file: %v", err)
+	}
+
+	start := time.Now()
+	err = executeSQLFileOn(executor, file)
+	duration := time.Since(start)
+	if err != nil && !recordFailure {
+		return duration, err
+	}
+
+	if recordErr := recordScript(executor, script, checksum, duration, err == nil); recordErr != nil {
+		// A failed script may have taken the session down with it, that error is the one worth reporting
+		if err != nil {
+			return duration, err
+		}
+		return duration, fmt.Errorf("failed to record '%s' in schema history: %v", file, recordErr)
+	}
+	if err == nil {
+		logger.Debug(fmt.Sprintf("Executed '%v' in %v", file, duration.Round(time.Millisecond)))
+	}
+	return duration, err
+}
+
+// Filters a setup down to the scripts that haven't been applied yet. Scripts that changed since they were applied
+// are an error: they're plain CREATEs, so running them again would only fail on the object that's already there,
+// and skipping them would leave the target behind the snapshot.
+func getPendingFiles(baseDir string, files map[string][]string, applied map[string]string) (map[string][]string, int, error) {
+	pending := make(map[string][]string)
+	count := 0
+	var changed []string
+
+	for _, phase := range generatedDirs {
+		for _, file := range files[phase] {
+			script := historyScriptName(baseDir, file)
+			checksum, err := hashFile(file)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			appliedChecksum, wasApplied := applied[script]
+			if wasApplied {
+				if appliedChecksum != checksum {
+					changed = append(changed, script)
+				}
+				continue
+			}
+			pending[phase] = append(pending[phase], file)
+			count++
+		}
+	}
+
+	if len(changed) > 0 {
+		for _, script := range changed {
+			logger.Warning(fmt.Sprintf("'%s' changed since it was applied.", script))
+		}
+		return nil, 0, fmt.Errorf("%d script(s) changed since they were applied. Bring the target in line with '--migrate --apply', or rebuild it with '--force'", len(changed))
+	}
+	return pending, count, nil
+}
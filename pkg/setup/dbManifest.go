@@ -0,0 +1,202 @@
+package setup
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jlammilliman/dbManager/pkg/logger"
+)
+
+// The manifest describes a generated snapshot: where it came from, what's in it, and the exact order to apply it in.
+// Hashes let setup catch scripts that were edited by hand after generation.
+
+var manifestFileName = "manifest.json"
+
+// Alongside the scripts we keep the introspected schema itself, so verification can work without the source server
+var schemaFileName = "schema.json"
+
+type Manifest struct {
+	SourceHost     string           `json:"sourceHost"`
+	SourceDatabase string           `json:"sourceDatabase"`
+	ServerVersion  string           `json:"serverVersion"`
+	GeneratedAt    time.Time        `json:"generatedAt"`
+	ObjectCounts   map[string]int   `json:"objectCounts"`
+	Scripts        []ManifestScript `json:"scripts"` // In the order setup should run them
+}
+
+type ManifestScript struct {
+	Phase string `json:"phase"`
+	Path  string `json:"path"` // Relative to the snapshot directory, always forward slashes
+	Hash  string `json:"sha256"`
+}
+
+// Looks up the version of SQL Server we generated from
+func getServerVersion(db *sql.DB) (string, error) {
+	var version string
+	err := db.QueryRow("SELECT CAST(SERVERPROPERTY('ProductVersion') AS NVARCHAR(128)) + ' ' + CAST(SERVERPROPERTY('Edition') AS NVARCHAR(128))").Scan(&version)
+	return version, err
+}
+
+// Hashes the contents of a script
+func hashFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Builds the manifest for a freshly generated snapshot. The script order is the phase order,
+// then the file prefixes within each phase, which is the topological order generation wrote them in.
+func buildManifest(baseDir, sourceHost, sourceDatabase, serverVersion string) (*Manifest, error) {
+	manifest := &Manifest{
+		SourceHost:     sourceHost,
+		SourceDatabase: sourceDatabase,
+		ServerVersion:  serverVersion,
+		GeneratedAt:    time.Now().UTC(),
+		ObjectCounts:   make(map[string]int),
+	}
+
+	for _, dir := range generatedDirs {
+		files, err := listFiles(filepath.Join(baseDir, dir))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			hash, err := hashFile(file)
+			if err != nil {
+				return nil, err
+			}
+
+			relativePath, err := filepath.Rel(baseDir, file)
+			if err != nil {
+				return nil, err
+			}
+
+			manifest.Scripts = append(manifest.Scripts, ManifestScript{
+				Phase: dir,
+				Path:  filepath.ToSlash(relativePath),
+				Hash:  hash,
+			})
+		}
+		manifest.ObjectCounts[dir] = len(files)
+	}
+
+	return manifest, nil
+}
+
+func writeManifest(baseDir string, manifest *Manifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(baseDir, manifestFileName), append(content, '\n'), 0644)
+}
+
+func readManifest(baseDir string) (*Manifest, error) {
+	content, err := os.ReadFile(filepath.Join(baseDir, manifestFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("malformed %s: %v", manifestFileName, err)
+	}
+	return &manifest, nil
+}
+
+func writeSchemaSnapshot(baseDir string, details *DatabaseDetails) error {
+	content, err := json.MarshalIndent(details, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(baseDir, schemaFileName), append(content, '\n'), 0644)
+}
+
+func readSchemaSnapshot(baseDir string) (*DatabaseDetails, error) {
+	content, err := os.ReadFile(filepath.Join(baseDir, schemaFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var details DatabaseDetails
+	if err := json.Unmarshal(content, &details); err != nil {
+		return nil, fmt.Errorf("malformed %s: %v", schemaFileName, err)
+	}
+	return &details, nil
+}
+
+// Works out which files setup should run for each phase, in order.
+// With a manifest, every script is checked against its hash first, and a mismatch stops setup unless forced.
+// Snapshots generated before manifests existed fall back to the directory listing.
+func getSetupFiles(baseDir string, forceRefresh bool) (map[string][]string, error) {
+	setupFiles := make(map[string][]string)
+
+	manifest, err := readManifest(baseDir)
+	if os.IsNotExist(err) {
+		logger.Warning(fmt.Sprintf("No %s found in '%s'. Falling back to directory order, scripts cannot be verified.", manifestFileName, baseDir))
+		for _, dir := range generatedDirs {
+			files, err := listFiles(filepath.Join(baseDir, dir))
+			if err != nil {
+				return nil, err
+			}
+			setupFiles[dir] = files
+		}
+		return setupFiles, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	logger.Debug(fmt.Sprintf("Using manifest for '%s' generated %s from '%s' (%s).",
+		manifest.SourceDatabase, manifest.GeneratedAt.Format(time.RFC3339), manifest.SourceHost, manifest.ServerVersion))
+
+	var mismatched []string
+	inManifest := make(map[string]bool)
+	for _, script := range manifest.Scripts {
+		path := filepath.Join(baseDir, filepath.FromSlash(script.Path))
+		inManifest[path] = true
+
+		hash, err := hashFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("script listed in manifest is missing: %v", err)
+		}
+		if hash != script.Hash {
+			mismatched = append(mismatched, script.Path)
+		}
+
+		setupFiles[script.Phase] = append(setupFiles[script.Phase], path)
+	}
+
+	// Anything added by hand after generation won't be run, so make sure nobody is surprised by that
+	for _, dir := range generatedDirs {
+		files, err := listFiles(filepath.Join(baseDir, dir))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if !inManifest[file] {
+				logger.Warning(fmt.Sprintf("'%s' is not in the manifest and will not be run.", file))
+			}
+		}
+	}
+
+	if len(mismatched) > 0 {
+		for _, path := range mismatched {
+			logger.Warning(fmt.Sprintf("'%s' does not match the hash recorded at generation. Was it edited by hand?", path))
+		}
+		if !forceRefresh {
+			return nil, fmt.Errorf("%d script(s) changed since generation. Regenerate with '--generate', or run with '--force' to apply them anyway", len(mismatched))
+		}
+	}
+
+	return setupFiles, nil
+}
@@ -0,0 +1,672 @@
+package setup
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jlammilliman/dbManager/pkg/config"
+	"github.com/jlammilliman/dbManager/pkg/logger"
+)
+
+// Migration turns the difference between the source (or snapshot) and the target into a T-SQL script, so a local
+// clone can be brought up to date in place instead of being dropped and rebuilt.
+// Anything additive or safely alterable is scripted. Anything destructive (extra objects, type rebuilds, identity changes)
+// is left as a comment at the top of the script for whoever reviews it.
+
+// A migration script, split into the phases it has to run in
+type migration struct {
+	dropForeignKeys []string // Changed foreign keys, and those sitting on altered columns
+	dropConstraints []string // Changed indexes, defaults, and checks, and those sitting on altered columns
+	schemas         []string
+	types           []string
+	sequences       []string
+	synonyms        []string
+	tables          []string
+	columns         []string
+	constraints     []string
+	foreignKeys     []string
+	modules         []string
+	functionDeps    []string // Columns, constraints, and indexes that call a function, so they wait for the modules
+	triggers        []string
+	manual          []string // Differences we won't touch automatically
+}
+
+// Builds a migration that brings the target in line with the source (or the snapshot at databases/<target>) and writes it
+// to outputPath, defaulting to databases/<target>/migration.sql. With apply set, the script is then run against the target.
+// Returns false if anything went wrong.
+func Migrate(config *config.Config, fromSnapshot bool, outputPath string, apply bool) bool {
+	source, sourceName, err := loadExpectedSchema(config, fromSnapshot)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to read schema from '%s': %v", sourceName, err))
+		return false
+	}
+
+	target, err := introspectDatabase(targetAsAdmin(config))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to read schema from target '%s': %v", config.TargetDB.Name, err))
+		return false
+	}
+
+	plan, err := buildMigration(source, target)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to build migration: %v", err))
+		return false
+	}
+
+	for _, note := range plan.manual {
+		logger.Warning(note)
+	}
+	if plan.statementCount() == 0 {
+		logger.Info(fmt.Sprintf("'%s' is already in line with '%s', nothing to migrate.", config.TargetDB.Name, sourceName))
+		return true
+	}
+
+	if outputPath == "" {
+		outputPath = filepath.Join("databases", config.TargetDB.Name, "migration.sql")
+	}
+	if err := writeReportFile(outputPath, []byte(plan.script(sourceName, config.TargetDB.Name))); err != nil {
+		logger.Error(fmt.Sprintf("Failed to write migration: %v", err))
+		return false
+	}
+	logger.Info(fmt.Sprintf("Wrote %d statement(s) to '%s'.", plan.statementCount(), outputPath))
+
+	if !apply {
+		logger.Message("Review the script, then run again with '--apply' to run it against the target.")
+		return true
+	}
+
+	logger.Debug(fmt.Sprintf("Applying '%s' to '%s'...", outputPath, config.TargetDB.Name))
+	db, err := openDatabase(targetAsAdmin(config))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to connect to target '%s': %v", config.TargetDB.Name, err))
+		return false
+	}
+	defer db.Close()
+
+	// Batches share a session, the same as they would under sqlcmd
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to connect to target '%s': %v", config.TargetDB.Name, err))
+		return false
+	}
+	defer conn.Close()
+
+	if err := ensureHistoryTable(conn); err != nil {
+		logger.Error(fmt.Sprintf("Failed to create schema history: %v", err))
+		return false
+	}
+
+	// The output path gets reused by every migration, so each run is recorded under when it happened instead
+	script := fmt.Sprintf("migration_%s.sql", time.Now().UTC().Format("20060102_150405"))
+	if err := applyScriptAs(conn, script, outputPath); err != nil {
+		logger.Error(fmt.Sprintf("Failed to apply migration: %v", err))
+		return false
+	}
+	logger.Info(fmt.Sprintf("Migrated '%s'.", config.TargetDB.Name))
+	return true
+}
+
+type migrationPhase struct {
+	name       string
+	statements []string
+}
+
+func (plan *migration) phases() []migrationPhase {
+	return []migrationPhase{
+		{"Drop changed foreign keys", plan.dropForeignKeys},
+		{"Drop changed constraints and indexes", plan.dropConstraints},
+		{"Schemas", plan.schemas},
+		{"Types", plan.types},
+		{"Sequences", plan.sequences},
+		{"Synonyms", plan.synonyms},
+		{"Tables", plan.tables},
+		{"Columns", plan.columns},
+		{"Constraints and indexes", plan.constraints},
+		{"Foreign keys", plan.foreignKeys},
+		{"Functions, views, and procedures", plan.modules},
+		{"Function dependents", plan.functionDeps},
+		{"Triggers", plan.triggers},
+	}
+}
+
+func (plan *migration) statementCount() int {
+	count := 0
+	for _, phase := range plan.phases() {
+		count += len(phase.statements)
+	}
+	return count
+}
+
+// Renders the migration, with the manual notes up top so they can't be missed
+func (plan *migration) script(sourceName, targetName string) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("-- Migrates '%s' to match '%s'\n", targetName, sourceName))
+	sb.WriteString(fmt.Sprintf("-- Generated %s\n", time.Now().UTC().Format(time.RFC3339)))
+
+	if len(plan.manual) > 0 {
+		sb.WriteString("--\n-- Not scripted, review by hand:\n")
+		for _, note := range plan.manual {
+			sb.WriteString("--   " + note + "\n")
+		}
+	}
+
+	for _, phase := range plan.phases() {
+		if len(phase.statements) == 0 {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("\n-- %s\n", phase.name))
+		for _, statement := range phase.statements {
+			// Every statement is its own batch, CREATE OR ALTER has to be the first thing in one
+			sb.WriteString("\n" + strings.TrimSpace(statement) + "\nGO\n")
+		}
+	}
+	return sb.String()
+}
+
+func buildMigration(source, target *DatabaseDetails) (*migration, error) {
+	plan := &migration{}
+	schemas := make(map[string]bool) // Schemas anything new lives in
+
+	// Types can't be altered in place, only created
+	sourceTypes := make(map[string]TypeDetails)
+	for _, details := range source.Types {
+		sourceTypes[qualifiedName(details.SchemaName, details.TypeName)] = details
+	}
+	for _, difference := range compareDefinitions("Type", typeDefinitions(source.Types), typeDefinitions(target.Types)) {
+		switch difference.Kind {
+		case DifferenceMissing:
+			details := sourceTypes[difference.Object]
+			schemas[details.SchemaName] = true
+			plan.types = append(plan.types, scriptType(details))
+		case DifferenceChanged:
+			plan.manual = append(plan.manual, fmt.Sprintf("Type '%s' changed. Types can't be altered, it has to be dropped and recreated along with everything using it.", difference.Object))
+		default:
+			plan.manual = append(plan.manual, extraNote(difference))
+		}
+	}
+
+	sourceSequences, targetSequences := make(map[string]SequenceDetails), make(map[string]SequenceDetails)
+	for _, sequence := range source.Sequences {
+		sourceSequences[qualifiedName(sequence.SchemaName, sequence.SequenceName)] = sequence
+	}
+	for _, sequence := range target.Sequences {
+		targetSequences[qualifiedName(sequence.SchemaName, sequence.SequenceName)] = sequence
+	}
+	for _, difference := range compareDefinitions("Sequence", sequenceDefinitions(source.Sequences), sequenceDefinitions(target.Sequences)) {
+		switch difference.Kind {
+		case DifferenceMissing:
+			sequence := sourceSequences[difference.Object]
+			schemas[sequence.SchemaName] = true
+			plan.sequences = append(plan.sequences, scriptSequence(sequence))
+		case DifferenceChanged:
+			sequence, existing := sourceSequences[difference.Object], targetSequences[difference.Object]
+			if scriptSequenceType(sequence.DataType) != scriptSequenceType(existing.DataType) {
+				plan.manual = append(plan.manual, fmt.Sprintf("Sequence '%s' changed type. It has to be dropped and recreated.", difference.Object))
+				continue
+			}
+			plan.sequences = append(plan.sequences, scriptAlterSequence(sequence))
+		default:
+			plan.manual = append(plan.manual, extraNote(difference))
+		}
+	}
+
+	sourceSynonyms := make(map[string]SynonymDetails)
+	for _, synonym := range source.Synonyms {
+		sourceSynonyms[qualifiedName(synonym.SchemaName, synonym.SynonymName)] = synonym
+	}
+	for _, difference := range compareDefinitions("Synonym", synonymDefinitions(source.Synonyms), synonymDefinitions(target.Synonyms)) {
+		switch difference.Kind {
+		case DifferenceMissing, DifferenceChanged:
+			synonym := sourceSynonyms[difference.Object]
+			schemas[synonym.SchemaName] = true
+			if difference.Kind == DifferenceChanged {
+				plan.synonyms = append(plan.synonyms, fmt.Sprintf("DROP SYNONYM %s;", QuoteQualifiedName(synonym.SchemaName, synonym.SynonymName)))
+			}
+			plan.synonyms = append(plan.synonyms, scriptSynonym(synonym))
+		default:
+			plan.manual = append(plan.manual, extraNote(difference))
+		}
+	}
+
+	if err := migrateTables(plan, source.Tables, target.Tables, schemas); err != nil {
+		return nil, err
+	}
+
+	if err := migrateModules(plan, source.Modules, target.Modules, schemas); err != nil {
+		return nil, err
+	}
+
+	sourceTriggers := make(map[string]TriggerDetails)
+	for _, trigger := range source.Triggers {
+		name := trigger.TriggerName
+		if trigger.SchemaName != "" {
+			name = qualifiedName(trigger.SchemaName, trigger.TriggerName)
+		}
+		sourceTriggers[name] = trigger
+	}
+	for _, difference := range compareDefinitions("Trigger", triggerDefinitions(source.Triggers), triggerDefinitions(target.Triggers)) {
+		switch difference.Kind {
+		case DifferenceMissing, DifferenceChanged:
+			trigger := sourceTriggers[difference.Object]
+			plan.triggers = append(plan.triggers, createOrAlter(trigger.Definition))
+
+			if trigger.IsDisabled {
+				plan.triggers = append(plan.triggers, scriptTriggerState(trigger, false))
+			} else if difference.Kind == DifferenceChanged {
+				plan.triggers = append(plan.triggers, scriptTriggerState(trigger, true))
+			}
+		default:
+			plan.manual = append(plan.manual, extraNote(difference))
+		}
+	}
+
+	// dbo always exists, everything else might not
+	var schemaNames []string
+	for schema := range schemas {
+		if schema != "" && schema != "dbo" {
+			schemaNames = append(schemaNames, schema)
+		}
+	}
+	sort.Strings(schemaNames)
+	for _, schema := range schemaNames {
+		plan.schemas = append(plan.schemas, fmt.Sprintf("IF SCHEMA_ID(N'%s') IS NULL EXEC(N'CREATE SCHEMA %s');",
+			escapeString(schema), escapeString(QuoteName(schema))))
+	}
+
+	return plan, nil
+}
+
+// Creates missing tables, and alters existing ones piece by piece
+func migrateTables(plan *migration, source, target []TableDetails, schemas map[string]bool) error {
+	sortedSource, err := sortTables(source)
+	if err != nil {
+		return err
+	}
+	targetTables := tablesByName(target)
+	sourceTables := tablesByName(source)
+	altered := make(map[string]map[string]bool) // Altered columns, by table
+
+	for _, table := range sortedSource {
+		name := qualifiedName(table.SchemaName, table.TableName)
+		existing, exists := targetTables[name]
+
+		if !exists {
+			// Foreign keys wait until every table exists, the same as generation
+			schemas[table.SchemaName] = true
+			plan.tables = append(plan.tables, scriptTable(table))
+			if constraints := scriptConstraints(table); constraints != "" {
+				plan.constraints = append(plan.constraints, constraints)
+			}
+			for _, key := range table.ForeignKeys {
+				if !key.DependsOnFunction { // The rest come with scriptFunctionDependents
+					plan.foreignKeys = append(plan.foreignKeys, scriptForeignKey(table, key))
+				}
+			}
+			if dependents := scriptFunctionDependents(table); dependents != "" {
+				plan.functionDeps = append(plan.functionDeps, dependents)
+			}
+			continue
+		}
+
+		altered[name] = migrateTable(plan, table, existing)
+	}
+
+	// Keys on other tables that point at an altered column would block it (or the index being rebuilt under it),
+	// so they come off first and go back on after
+	for _, existing := range target {
+		tableName := QuoteQualifiedName(existing.SchemaName, existing.TableName)
+		for _, key := range existing.ForeignKeys {
+			if !touchesColumns(key.ReferencedColumns, altered[qualifiedName(key.ReferencedSchema, key.ReferencedTable)]) {
+				continue
+			}
+			drop := fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s;", tableName, QuoteName(key.Name))
+			if stringInSlice(drop, plan.dropForeignKeys) {
+				continue // Already being rebuilt along with its own table
+			}
+			plan.dropForeignKeys = append(plan.dropForeignKeys, drop)
+
+			// Put back what the source has, or what was there if the source doesn't have it
+			create, dependsOnFunction := scriptForeignKey(existing, key), key.DependsOnFunction
+			if table, exists := sourceTables[qualifiedName(existing.SchemaName, existing.TableName)]; exists {
+				for _, sourceKey := range table.ForeignKeys {
+					if sourceKey.Name == key.Name {
+						create, dependsOnFunction = scriptForeignKey(table, sourceKey), sourceKey.DependsOnFunction
+					}
+				}
+			}
+			if stringInSlice(create, plan.foreignKeys) || stringInSlice(create, plan.functionDeps) {
+				continue
+			}
+			if dependsOnFunction {
+				plan.functionDeps = append(plan.functionDeps, create)
+			} else {
+				plan.foreignKeys = append(plan.foreignKeys, create)
+			}
+		}
+	}
+
+	for _, difference := range compareTables(source, target) {
+		if difference.ObjectType == "Table" && difference.Kind == DifferenceExtra {
+			plan.manual = append(plan.manual, extraNote(difference))
+		}
+	}
+	return nil
+}
+
+// Brings an existing table in line piece by piece. Returns the columns it alters, so keys pointing at them can be rebuilt
+func migrateTable(plan *migration, table, existing TableDetails) map[string]bool {
+	tableName := QuoteQualifiedName(table.SchemaName, table.TableName)
+	name := qualifiedName(table.SchemaName, table.TableName)
+
+	existingColumns := make(map[string]ColumnDetails)
+	for _, col := range existing.Columns {
+		existingColumns[col.Name] = col
+	}
+
+	sourceDefaults, existingDefaults := make(map[string]ConstraintDetails), make(map[string]ConstraintDetails)
+	for _, constraint := range table.DefaultConstraints {
+		sourceDefaults[constraint.Column] = constraint
+	}
+	for _, constraint := range existing.DefaultConstraints {
+		existingDefaults[constraint.Column] = constraint
+	}
+
+	// Columns being altered. Anything built on them has to come off first, and go back on after
+	altered := make(map[string]bool)
+	addedDefaults := make(map[string]bool)
+
+	for _, col := range table.Columns {
+		current, exists := existingColumns[col.Name]
+
+		if !exists {
+			statement := fmt.Sprintf("ALTER TABLE %s ADD %s", tableName, scriptColumn(col))
+			// A default has to come along with the column, or NOT NULL can't be added to a table with rows in it
+			if constraint, hasDefault := sourceDefaults[col.Name]; hasDefault {
+				statement += fmt.Sprintf(" CONSTRAINT %s DEFAULT %s", QuoteName(constraint.Name), constraint.Definition)
+				addedDefaults[col.Name] = true
+			} else if !col.IsNullable && !col.IsIdentity && !col.IsComputed && !col.IsRowVersion {
+				plan.manual = append(plan.manual, fmt.Sprintf("Column '%s.%s' is NOT NULL without a default. Adding it fails if the table has rows.", name, col.Name))
+			}
+			if col.DependsOnFunction {
+				plan.functionDeps = append(plan.functionDeps, statement+";")
+			} else {
+				plan.columns = append(plan.columns, statement+";")
+			}
+			continue
+		}
+
+		if scriptColumn(col) == scriptColumn(current) {
+			continue
+		}
+
+		// ALTER COLUMN can only change the type, collation, and nullability
+		if col.IsComputed || current.IsComputed || col.IsIdentity != current.IsIdentity || col.IsRowVersion || current.IsRowVersion {
+			plan.manual = append(plan.manual, fmt.Sprintf("Column '%s.%s' changed in a way ALTER COLUMN can't handle (computed, identity, or rowversion). Expected: %s", name, col.Name, scriptColumn(col)))
+			continue
+		}
+		if col.IsIdentity && (col.IdentitySeed != current.IdentitySeed || col.IdentityIncrement != current.IdentityIncrement) {
+			plan.manual = append(plan.manual, fmt.Sprintf("Column '%s.%s' has a different identity seed or increment, which can't be altered.", name, col.Name))
+			continue
+		}
+
+		parts := []string{QuoteName(col.Name), scriptColumnType(col)}
+		if col.Collation != "" {
+			parts = append(parts, "COLLATE "+col.Collation)
+		}
+		if col.IsNullable {
+			parts = append(parts, "NULL")
+		} else {
+			parts = append(parts, "NOT NULL")
+		}
+		plan.columns = append(plan.columns, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s;", tableName, strings.Join(parts, " ")))
+		altered[col.Name] = true
+	}
+
+	for _, col := range existing.Columns {
+		if !columnInTable(col.Name, table) {
+			plan.manual = append(plan.manual, fmt.Sprintf("Column '%s.%s' exists on the target but not the source. Left in place.", name, col.Name))
+		}
+	}
+
+	if primaryKeyDefinitions(table)[name] != primaryKeyDefinitions(existing)[name] {
+		plan.manual = append(plan.manual, fmt.Sprintf("Primary key of '%s' changed. Expected: %s", name, primaryKeyDefinitions(table)[name]))
+	}
+
+	// Foreign keys
+	existingKeys := make(map[string]ForeignKeyDetails)
+	for _, key := range existing.ForeignKeys {
+		existingKeys[key.Name] = key
+	}
+	for _, key := range table.ForeignKeys {
+		current, exists := existingKeys[key.Name]
+		rebuild := exists && (scriptForeignKey(table, key) != scriptForeignKey(existing, current) || touchesColumns(current.Columns, altered))
+		if exists && !rebuild {
+			continue
+		}
+		if rebuild {
+			plan.dropForeignKeys = append(plan.dropForeignKeys, fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s;", tableName, QuoteName(key.Name)))
+		}
+		if key.DependsOnFunction {
+			plan.functionDeps = append(plan.functionDeps, scriptForeignKey(table, key))
+		} else {
+			plan.foreignKeys = append(plan.foreignKeys, scriptForeignKey(table, key))
+		}
+	}
+	for _, key := range existing.ForeignKeys {
+		if !foreignKeyInTable(key.Name, table) {
+			plan.manual = append(plan.manual, fmt.Sprintf("Foreign key '%s.%s' exists on the target but not the source. Left in place.", name, key.Name))
+		}
+	}
+
+	// Indexes and unique constraints
+	existingIndexes := make(map[string]IndexDetails)
+	for _, index := range existing.Indexes {
+		existingIndexes[index.Name] = index
+	}
+	for _, index := range table.Indexes {
+		current, exists := existingIndexes[index.Name]
+		rebuild := exists && (scriptIndex(table, index) != scriptIndex(existing, current) || touchesColumns(indexColumnNames(current), altered))
+		if exists && !rebuild {
+			continue
+		}
+		if rebuild {
+			plan.dropConstraints = append(plan.dropConstraints, scriptDropIndex(existing, current))
+		}
+		if indexDependsOnFunction(table, index) {
+			plan.functionDeps = append(plan.functionDeps, scriptIndex(table, index))
+		} else {
+			plan.constraints = append(plan.constraints, scriptIndex(table, index))
+		}
+	}
+	for _, index := range existing.Indexes {
+		if _, exists := indexDefinitions(table)[qualifiedName(name, index.Name)]; !exists {
+			plan.manual = append(plan.manual, fmt.Sprintf("Index '%s.%s' exists on the target but not the source. Left in place.", name, index.Name))
+		}
+	}
+
+	// Defaults, matched up by column since their names are frequently system generated
+	for _, constraint := range table.DefaultConstraints {
+		if addedDefaults[constraint.Column] {
+			continue
+		}
+		current, exists := existingDefaults[constraint.Column]
+		rebuild := exists && (current.Definition != constraint.Definition || altered[constraint.Column])
+		if exists && !rebuild {
+			continue
+		}
+		if rebuild {
+			plan.dropConstraints = append(plan.dropConstraints, fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s;", tableName, QuoteName(current.Name)))
+		}
+		statement := fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s DEFAULT %s FOR %s;",
+			tableName, QuoteName(constraint.Name), constraint.Definition, QuoteName(constraint.Column))
+		if constraint.DependsOnFunction {
+			plan.functionDeps = append(plan.functionDeps, statement)
+		} else {
+			plan.constraints = append(plan.constraints, statement)
+		}
+	}
+	for _, constraint := range existing.DefaultConstraints {
+		if _, exists := sourceDefaults[constraint.Column]; !exists {
+			plan.manual = append(plan.manual, fmt.Sprintf("Default on '%s.%s' exists on the target but not the source. Left in place.", name, constraint.Column))
+		}
+	}
+
+	// Checks. We don't know which columns a check uses, so altered columns are left to fail loudly if they conflict
+	existingChecks := make(map[string]ConstraintDetails)
+	for _, constraint := range existing.CheckConstraints {
+		existingChecks[constraint.Name] = constraint
+	}
+	sourceChecks := make(map[string]bool)
+	for _, constraint := range table.CheckConstraints {
+		sourceChecks[constraint.Name] = true
+		current, exists := existingChecks[constraint.Name]
+		if exists && scriptCheckConstraint(existing, current) == scriptCheckConstraint(table, constraint) {
+			continue
+		}
+		if exists {
+			plan.dropConstraints = append(plan.dropConstraints, fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s;", tableName, QuoteName(current.Name)))
+		}
+		if constraint.DependsOnFunction {
+			plan.functionDeps = append(plan.functionDeps, scriptCheckConstraint(table, constraint))
+		} else {
+			plan.constraints = append(plan.constraints, scriptCheckConstraint(table, constraint))
+		}
+	}
+	for _, constraint := range existing.CheckConstraints {
+		if !sourceChecks[constraint.Name] {
+			plan.manual = append(plan.manual, fmt.Sprintf("Check '%s.%s' exists on the target but not the source. Left in place.", name, constraint.Name))
+		}
+	}
+	return altered
+}
+
+// Modules that are missing or changed are scripted as CREATE OR ALTER, in dependency order
+func migrateModules(plan *migration, source, target []ModuleDetails, schemas map[string]bool) error {
+	sortedSource, err := sortModules(source)
+	if err != nil {
+		return err
+	}
+
+	targetDefinitions := make(map[string]string)
+	for _, module := range target {
+		targetDefinitions[module.ObjectType+" "+qualifiedName(module.SchemaName, module.ObjectName)] = normalizeDefinition(module.Definition)
+	}
+
+	for _, module := range sortedSource {
+		current, exists := targetDefinitions[module.ObjectType+" "+qualifiedName(module.SchemaName, module.ObjectName)]
+		if exists && current == normalizeDefinition(module.Definition) {
+			continue
+		}
+		schemas[module.SchemaName] = true
+		plan.modules = append(plan.modules, createOrAlter(module.Definition))
+	}
+
+	for _, objectType := range []string{"Function", "View", "Procedure"} {
+		for _, difference := range compareDefinitions(objectType, moduleDefinitions(source, objectType), moduleDefinitions(target, objectType)) {
+			if difference.Kind == DifferenceExtra {
+				plan.manual = append(plan.manual, extraNote(difference))
+			}
+		}
+	}
+	return nil
+}
+
+// Matches the CREATE at the start of a module, skipping any comments ahead of it
+var createModulePattern = regexp.MustCompile(`(?is)^((?:\s|--[^\n]*\n|/\*.*?\*/)*)CREATE\s+(PROCEDURE|PROC|FUNCTION|VIEW|TRIGGER)\b`)
+
+// Turns a module's CREATE into CREATE OR ALTER, so it works whether or not the module exists yet
+func createOrAlter(definition string) string {
+	return createModulePattern.ReplaceAllString(definition, "${1}CREATE OR ALTER $2")
+}
+
+// Builds the ALTER SEQUENCE for a sequence whose type hasn't changed. The current value is left alone
+func scriptAlterSequence(sequence SequenceDetails) string {
+	parts := []string{
+		"ALTER SEQUENCE " + QuoteQualifiedName(sequence.SchemaName, sequence.SequenceName),
+		"INCREMENT BY " + sequence.Increment,
+		"MINVALUE " + sequence.MinValue,
+		"MAXVALUE " + sequence.MaxValue,
+	}
+
+	if sequence.IsCycling {
+		parts = append(parts, "CYCLE")
+	} else {
+		parts = append(parts, "NO CYCLE")
+	}
+
+	if !sequence.IsCached {
+		parts = append(parts, "NO CACHE")
+	} else if sequence.CacheSize > 0 {
+		parts = append(parts, fmt.Sprintf("CACHE %d", sequence.CacheSize))
+	} else {
+		parts = append(parts, "CACHE")
+	}
+
+	return strings.Join(parts, "\n\t") + ";"
+}
+
+// Unique constraints are dropped as constraints, everything else as an index
+func scriptDropIndex(table TableDetails, index IndexDetails) string {
+	tableName := QuoteQualifiedName(table.SchemaName, table.TableName)
+	if index.IsUniqueConstraint {
+		return fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s;", tableName, QuoteName(index.Name))
+	}
+	return fmt.Sprintf("DROP INDEX %s ON %s;", QuoteName(index.Name), tableName)
+}
+
+// Database level triggers have no schema
+func quoteTriggerName(trigger TriggerDetails) string {
+	if trigger.SchemaName == "" {
+		return QuoteName(trigger.TriggerName)
+	}
+	return QuoteQualifiedName(trigger.SchemaName, trigger.TriggerName)
+}
+
+func extraNote(difference Difference) string {
+	return fmt.Sprintf("%s '%s' exists on the target but not the source. Left in place.", difference.ObjectType, difference.Object)
+}
+
+// Escapes a value for use inside of a N'...' literal
+func escapeString(value string) string {
+	return strings.ReplaceAll(value, "'", "''")
+}
+
+func columnInTable(name string, table TableDetails) bool {
+	for _, col := range table.Columns {
+		if col.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func foreignKeyInTable(name string, table TableDetails) bool {
+	for _, key := range table.ForeignKeys {
+		if key.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func indexColumnNames(index IndexDetails) []string {
+	names := append([]string{}, index.IncludedColumns...)
+	for _, col := range index.Columns {
+		names = append(names, col.Name)
+	}
+	return names
+}
+
+func touchesColumns(columns []string, altered map[string]bool) bool {
+	for _, col := range columns {
+		if altered[col] {
+			return true
+		}
+	}
+	return false
+}
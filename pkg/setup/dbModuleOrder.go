@@ -0,0 +1,165 @@
+package setup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jlammilliman/dbManager/pkg/logger"
+)
+
+// Functions, views, and procedures can depend on each other in any direction: a view calling a scalar function,
+// an inline function selecting from a view, a view on a view. Setup applies them as one phase, ordered by the
+// references generation recorded in schema.json. Anything that still fails gets retried until no more progress is made.
+
+// The single phase every module directory is merged into
+var modulePhase = "modules"
+
+// Scripts are named NNNN_schema.name.sql, the prefix is only there for ordering
+var scriptPrefixPattern = regexp.MustCompile(`^\d+_`)
+
+// The phases setup runs in: generatedDirs, with the module directories collapsed into modulePhase where the first of them was
+func setupPhases() []string {
+	var phases []string
+	for _, dir := range generatedDirs {
+		if !isModuleDir(dir) {
+			phases = append(phases, dir)
+		} else if !stringInSlice(modulePhase, phases) {
+			phases = append(phases, modulePhase)
+		}
+	}
+	return phases
+}
+
+func isModuleDir(dir string) bool {
+	for _, moduleDir := range moduleDirs {
+		if dir == moduleDir {
+			return true
+		}
+	}
+	return false
+}
+
+// Moves every module script into modulePhase, in dependency order. Without a usable schema.json, the file prefixes are used
+// instead, which is the order generation sorted them in
+func orderModuleFiles(baseDir string, files map[string][]string) map[string][]string {
+	ordered := make(map[string][]string)
+	var moduleFiles []string
+	for phase, phaseFiles := range files {
+		if isModuleDir(phase) {
+			moduleFiles = append(moduleFiles, phaseFiles...)
+		} else {
+			ordered[phase] = phaseFiles
+		}
+	}
+
+	// Prefixes are shared across the module directories, so this alone gets a fresh generation right
+	sort.Slice(moduleFiles, func(i, j int) bool {
+		return filepath.Base(moduleFiles[i]) < filepath.Base(moduleFiles[j])
+	})
+	ordered[modulePhase] = moduleFiles
+
+	details, err := readSchemaSnapshot(baseDir)
+	if err != nil {
+		logger.Debug(fmt.Sprintf("No module dependencies available (%v), ordering modules by file name.", err))
+		return ordered
+	}
+
+	// Only the modules being applied matter, anything already on the target is already satisfied
+	modulesByName := make(map[string]ModuleDetails)
+	for _, module := range details.Modules {
+		modulesByName[qualifiedName(module.SchemaName, module.ObjectName)] = module
+	}
+	filesByName := make(map[string]string)
+	var pending []ModuleDetails
+	for _, file := range moduleFiles {
+		name := strings.TrimSuffix(scriptPrefixPattern.ReplaceAllString(filepath.Base(file), ""), ".sql")
+		if module, exists := modulesByName[name]; exists {
+			filesByName[name] = file
+			pending = append(pending, module)
+		}
+	}
+
+	sortedModules, err := sortModules(pending)
+	if err != nil {
+		logger.Warning(fmt.Sprintf("Failed to order modules by dependency (%v), ordering by file name.", err))
+		return ordered
+	}
+
+	var sortedFiles []string
+	for _, module := range sortedModules {
+		sortedFiles = append(sortedFiles, filesByName[qualifiedName(module.SchemaName, module.ObjectName)])
+	}
+	// Hand written modules aren't in the snapshot, they go last and lean on the retries
+	for _, file := range moduleFiles {
+		if !stringInSlice(file, sortedFiles) {
+			sortedFiles = append(sortedFiles, file)
+		}
+	}
+	ordered[modulePhase] = sortedFiles
+	return ordered
+}
+
+// Runs .sql files like executeSQLFiles, but a failure doesn't stop the rest. Failed files are retried for as long as
+// each pass gets at least one more of them through, then whatever is left is reported with its own error.
+// Only that last failure makes it into the schema history, the earlier ones were just waiting on something.
+func executeSQLFilesWithRetry(server, port, username, password, database, baseDir string, files []string) error {
+	connString := fmt.Sprintf("server=%s;port=%s;user id=%s;password=%s;database=%s", server, port, username, password, database)
+	db, err := sql.Open("mssql", connString)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the database: %v", err)
+	}
+	defer db.Close()
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to connect to the database: %v", err)
+	}
+	defer conn.Close()
+
+	if err := ensureHistoryTable(conn); err != nil {
+		return fmt.Errorf("failed to create schema history: %v", err)
+	}
+
+	remaining := files
+	for pass := 1; ; pass++ {
+		var failed []string
+		failures := make(map[string]error)
+		durations := make(map[string]time.Duration)
+		for _, file := range remaining {
+			duration, err := attemptScript(conn, historyScriptName(baseDir, file), file, false)
+			if err != nil {
+				failed = append(failed, file)
+				failures[file] = err
+				durations[file] = duration
+			}
+		}
+
+		if len(failed) == 0 {
+			return nil
+		}
+
+		// Nothing new got through, so these are the real blockers
+		if len(failed) == len(remaining) {
+			for _, file := range failed {
+				logger.Error(fmt.Sprintf("'%s' could not be created: %v", file, failures[file]))
+				checksum, err := hashFile(file)
+				if err == nil {
+					err = recordScript(conn, historyScriptName(baseDir, file), checksum, durations[file], false)
+				}
+				if err != nil {
+					logger.Warning(fmt.Sprintf("Failed to record '%s' in schema history: %v", file, err))
+				}
+			}
+			return fmt.Errorf("%d script(s) could not be applied after %d pass(es)", len(failed), pass)
+		}
+
+		logger.Debug(fmt.Sprintf("%d script(s) failed on pass %d, retrying them.", len(failed), pass))
+		remaining = failed
+	}
+}
@@ -0,0 +1,320 @@
+package setup
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jlammilliman/dbManager/pkg/logger"
+)
+
+// Lookups for the objects that live alongside tables and modules: user-defined types, sequences, synonyms, and triggers
+
+// An alias type (CREATE TYPE ... FROM) or a table type (CREATE TYPE ... AS TABLE)
+type TypeDetails struct {
+	SchemaName  string
+	TypeName    string
+	IsTableType bool
+	BaseType    ColumnDetails   // Alias types only. Name is unused
+	Columns     []ColumnDetails // Table types only, as is everything below
+
+	PrimaryKeyColumns   []string
+	PrimaryKeyClustered bool
+	Indexes             []IndexDetails // Unique constraints and inline indexes
+}
+
+type SequenceDetails struct {
+	SchemaName   string
+	SequenceName string
+	DataType     ColumnDetails // Name is unused
+	StartValue   string        // Values are kept as text, a sequence can be any exact numeric type
+	Increment    string
+	MinValue     string
+	MaxValue     string
+	IsCycling    bool
+	IsCached     bool
+	CacheSize    int // 0 lets SQL Server pick
+}
+
+type SynonymDetails struct {
+	SchemaName     string
+	SynonymName    string
+	BaseObjectName string
+}
+
+// A DML trigger on a table or view, or a database level DDL trigger (which has no parent)
+type TriggerDetails struct {
+	SchemaName  string
+	TriggerName string
+	ParentName  string
+	IsDisabled  bool
+	Definition  string
+}
+
+// Query to get every user-defined alias and table type. Alias types come first, since table types may use them
+func getTypes(db *sql.DB) ([]TypeDetails, error) {
+	query := `
+	SELECT
+		SCHEMA_NAME(t.schema_id),
+		t.name,
+		t.is_table_type,
+		TYPE_NAME(t.system_type_id),
+		CASE WHEN TYPE_NAME(t.system_type_id) IN ('nchar', 'nvarchar') AND t.max_length <> -1
+			THEN t.max_length / 2 ELSE t.max_length END,
+		t.precision,
+		t.scale,
+		t.is_nullable
+	FROM sys.types t
+	WHERE t.is_user_defined = 1
+	ORDER BY t.is_table_type, SCHEMA_NAME(t.schema_id), t.name
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var types []TypeDetails
+	for rows.Next() {
+		var (
+			details  TypeDetails
+			baseType ColumnDetails
+		)
+		err := rows.Scan(&details.SchemaName, &details.TypeName, &details.IsTableType, &baseType.Type,
+			&baseType.MaxLength, &baseType.Precision, &baseType.Scale, &baseType.IsNullable)
+		if err != nil {
+			return nil, err
+		}
+
+		// sys.types keeps fractional second precision in scale
+		baseType.DateTimePrecision = baseType.Scale
+		details.BaseType = baseType
+		types = append(types, details)
+	}
+
+	// Table types are shaped like tables, so fill in their columns and keys
+	for i := range types {
+		if !types[i].IsTableType {
+			continue
+		}
+		columns, err := getTableTypeColumns(db, types[i].SchemaName, types[i].TypeName)
+		if err != nil {
+			return nil, err
+		}
+		types[i].Columns = columns
+
+		if err := getTableTypeIndexes(db, &types[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	logger.Debug(fmt.Sprintf("Successfully retrieved %d user-defined types.", len(types)))
+	return types, nil
+}
+
+// Query to get the columns of a single table type, in declared order
+func getTableTypeColumns(db *sql.DB, schemaName, typeName string) ([]ColumnDetails, error) {
+	query := `
+	SELECT
+		c.name,
+		TYPE_NAME(c.system_type_id),
+		CASE WHEN ty.is_user_defined = 1 THEN SCHEMA_NAME(ty.schema_id) ELSE '' END,
+		CASE WHEN ty.is_user_defined = 1 THEN ty.name ELSE '' END,
+		CASE WHEN TYPE_NAME(c.system_type_id) IN ('nchar', 'nvarchar') AND c.max_length <> -1
+			THEN c.max_length / 2 ELSE c.max_length END,
+		c.precision,
+		c.scale,
+		c.is_nullable,
+		c.is_identity,
+		CAST(COALESCE(ic.seed_value, 0) AS BIGINT),
+		CAST(COALESCE(ic.increment_value, 0) AS BIGINT),
+		COALESCE(c.collation_name, '')
+	FROM sys.table_types tt
+	JOIN sys.columns c ON c.object_id = tt.type_table_object_id
+	JOIN sys.types ty ON ty.user_type_id = c.user_type_id
+	LEFT JOIN sys.identity_columns ic ON ic.object_id = c.object_id AND ic.column_id = c.column_id
+	WHERE SCHEMA_NAME(tt.schema_id) = @p1 AND tt.name = @p2
+	ORDER BY c.column_id
+	`
+	rows, err := db.Query(query, schemaName, typeName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []ColumnDetails
+	for rows.Next() {
+		var col ColumnDetails
+		err := rows.Scan(&col.Name, &col.Type, &col.UserTypeSchema, &col.UserTypeName, &col.MaxLength,
+			&col.Precision, &col.Scale, &col.IsNullable, &col.IsIdentity, &col.IdentitySeed, &col.IdentityIncrement, &col.Collation)
+		if err != nil {
+			return nil, err
+		}
+		col.DateTimePrecision = col.Scale
+		columns = append(columns, col)
+	}
+	return columns, nil
+}
+
+// Query to get the primary key, unique constraints, and inline indexes of a single table type.
+// Constraints on a table type can't be named, so only the inline indexes keep theirs
+func getTableTypeIndexes(db *sql.DB, details *TypeDetails) error {
+	query := `
+	SELECT
+		i.name,
+		CASE WHEN i.type = 1 THEN 1 ELSE 0 END,
+		i.is_unique,
+		i.is_unique_constraint,
+		i.is_primary_key,
+		c.name,
+		ic.is_descending_key
+	FROM sys.table_types tt
+	JOIN sys.indexes i ON i.object_id = tt.type_table_object_id
+	JOIN sys.index_columns ic ON ic.object_id = i.object_id AND ic.index_id = i.index_id
+	JOIN sys.columns c ON c.object_id = ic.object_id AND c.column_id = ic.column_id
+	WHERE SCHEMA_NAME(tt.schema_id) = @p1 AND tt.name = @p2
+		AND i.type IN (1, 2) -- Clustered and nonclustered rowstore indexes
+	ORDER BY i.index_id, ic.key_ordinal
+	`
+	rows, err := db.Query(query, details.SchemaName, details.TypeName)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			index        IndexDetails
+			isPrimaryKey bool
+			columnName   string
+			isDescending bool
+		)
+		err := rows.Scan(&index.Name, &index.IsClustered, &index.IsUnique, &index.IsUniqueConstraint, &isPrimaryKey, &columnName, &isDescending)
+		if err != nil {
+			return err
+		}
+
+		if isPrimaryKey {
+			details.PrimaryKeyColumns = append(details.PrimaryKeyColumns, columnName)
+			details.PrimaryKeyClustered = index.IsClustered
+			continue
+		}
+
+		// Rows come back grouped by index, so we only ever need to check the last one
+		if len(details.Indexes) == 0 || details.Indexes[len(details.Indexes)-1].Name != index.Name {
+			details.Indexes = append(details.Indexes, index)
+		}
+		last := &details.Indexes[len(details.Indexes)-1]
+		last.Columns = append(last.Columns, IndexColumnDetails{Name: columnName, IsDescending: isDescending})
+	}
+	return rows.Err()
+}
+
+// Query to get every sequence
+func getSequences(db *sql.DB) ([]SequenceDetails, error) {
+	query := `
+	SELECT
+		SCHEMA_NAME(s.schema_id),
+		s.name,
+		TYPE_NAME(s.system_type_id),
+		s.precision,
+		CAST(s.start_value AS NVARCHAR(40)),
+		CAST(s.increment AS NVARCHAR(40)),
+		CAST(s.minimum_value AS NVARCHAR(40)),
+		CAST(s.maximum_value AS NVARCHAR(40)),
+		s.is_cycling,
+		s.is_cached,
+		COALESCE(s.cache_size, 0)
+	FROM sys.sequences s
+	ORDER BY SCHEMA_NAME(s.schema_id), s.name
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sequences []SequenceDetails
+	for rows.Next() {
+		var sequence SequenceDetails
+		err := rows.Scan(&sequence.SchemaName, &sequence.SequenceName, &sequence.DataType.Type, &sequence.DataType.Precision,
+			&sequence.StartValue, &sequence.Increment, &sequence.MinValue, &sequence.MaxValue,
+			&sequence.IsCycling, &sequence.IsCached, &sequence.CacheSize)
+		if err != nil {
+			return nil, err
+		}
+		sequences = append(sequences, sequence)
+	}
+
+	logger.Debug(fmt.Sprintf("Successfully retrieved %d sequences.", len(sequences)))
+	return sequences, nil
+}
+
+// Query to get every synonym
+func getSynonyms(db *sql.DB) ([]SynonymDetails, error) {
+	query := `
+	SELECT SCHEMA_NAME(s.schema_id), s.name, s.base_object_name
+	FROM sys.synonyms s
+	ORDER BY SCHEMA_NAME(s.schema_id), s.name
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var synonyms []SynonymDetails
+	for rows.Next() {
+		var synonym SynonymDetails
+		if err := rows.Scan(&synonym.SchemaName, &synonym.SynonymName, &synonym.BaseObjectName); err != nil {
+			return nil, err
+		}
+		synonyms = append(synonyms, synonym)
+	}
+
+	logger.Debug(fmt.Sprintf("Successfully retrieved %d synonyms.", len(synonyms)))
+	return synonyms, nil
+}
+
+// Query to get every DML trigger and database DDL trigger along with its definition
+func getTriggers(db *sql.DB) ([]TriggerDetails, error) {
+	query := `
+	SELECT
+		COALESCE(OBJECT_SCHEMA_NAME(tr.parent_id), ''),
+		tr.name,
+		COALESCE(OBJECT_NAME(tr.parent_id), ''),
+		tr.is_disabled,
+		m.definition
+	FROM sys.triggers tr
+	JOIN sys.sql_modules m ON m.object_id = tr.object_id
+	WHERE tr.is_ms_shipped = 0
+	ORDER BY tr.parent_class, 1, 3, tr.name
+	`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var triggers []TriggerDetails
+	for rows.Next() {
+		var (
+			trigger    TriggerDetails
+			definition sql.NullString
+		)
+		err := rows.Scan(&trigger.SchemaName, &trigger.TriggerName, &trigger.ParentName, &trigger.IsDisabled, &definition)
+		if err != nil {
+			return nil, err
+		}
+
+		// Encrypted triggers don't expose a definition, there is nothing we can script
+		if !definition.Valid {
+			logger.Warning(fmt.Sprintf("Skipping trigger '%s': definition is not available (WITH ENCRYPTION?)", trigger.TriggerName))
+			continue
+		}
+		trigger.Definition = definition.String
+		triggers = append(triggers, trigger)
+	}
+
+	logger.Debug(fmt.Sprintf("Successfully retrieved %d triggers.", len(triggers)))
+	return triggers, nil
+}
@@ -0,0 +1,232 @@
+package setup
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jlammilliman/dbManager/pkg/logger"
+)
+
+// Verification findings in forms other tools can read. JSON for scripting, JUnit XML for CI dashboards.
+// Every table or object checked becomes one test case, failing if it has any differences.
+
+// Where to write reports. Empty paths are skipped
+type VerifyReports struct {
+	JSONPath  string
+	JUnitPath string
+}
+
+type VerifyReport struct {
+	Source      string         `json:"source"`
+	Target      string         `json:"target"`
+	GeneratedAt time.Time      `json:"generatedAt"`
+	Matches     bool           `json:"matches"`
+	Objects     []ObjectReport `json:"objects"`
+}
+
+// A single table or object, and everything that differs about it
+type ObjectReport struct {
+	ObjectType  string       `json:"objectType"`
+	Object      string       `json:"object"`
+	Differences []Difference `json:"differences"`
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// The order object types show up in reports, matching the order they're compared in
+var reportObjectTypes = []string{"Table", "Type", "Sequence", "Synonym", "Function", "View", "Procedure", "Trigger"}
+
+// Groups differences by the table or object they belong to. Objects without differences are kept as passing cases
+func buildVerifyReport(source, target string, sourceDetails, targetDetails *DatabaseDetails, differences []Difference) *VerifyReport {
+	report := &VerifyReport{
+		Source:      source,
+		Target:      target,
+		GeneratedAt: time.Now().UTC(),
+		Matches:     len(differences) == 0,
+	}
+
+	// Every object either side has
+	names := make(map[string]map[string]bool)
+	addNames := func(objectType string, definitions map[string]string) {
+		if names[objectType] == nil {
+			names[objectType] = make(map[string]bool)
+		}
+		for name := range definitions {
+			names[objectType][name] = true
+		}
+	}
+	for _, details := range []*DatabaseDetails{sourceDetails, targetDetails} {
+		tableNames := make(map[string]string)
+		for name := range tablesByName(details.Tables) {
+			tableNames[name] = name
+		}
+		addNames("Table", tableNames)
+		addNames("Type", typeDefinitions(details.Types))
+		addNames("Sequence", sequenceDefinitions(details.Sequences))
+		addNames("Synonym", synonymDefinitions(details.Synonyms))
+		for _, objectType := range []string{"Function", "View", "Procedure"} {
+			addNames(objectType, moduleDefinitions(details.Modules, objectType))
+		}
+		addNames("Trigger", triggerDefinitions(details.Triggers))
+	}
+
+	// Table level differences roll up into their table
+	grouped := make(map[string]map[string][]Difference)
+	for _, difference := range differences {
+		objectType, object := difference.ObjectType, difference.Object
+		if difference.Table != "" {
+			objectType, object = "Table", difference.Table
+		}
+		if grouped[objectType] == nil {
+			grouped[objectType] = make(map[string][]Difference)
+		}
+		grouped[objectType][object] = append(grouped[objectType][object], difference)
+	}
+
+	for _, objectType := range reportObjectTypes {
+		var sortedNames []string
+		for name := range names[objectType] {
+			sortedNames = append(sortedNames, name)
+		}
+		sort.Strings(sortedNames)
+
+		for _, name := range sortedNames {
+			objectDifferences := grouped[objectType][name]
+			if objectDifferences == nil {
+				objectDifferences = []Difference{}
+			}
+			report.Objects = append(report.Objects, ObjectReport{
+				ObjectType:  objectType,
+				Object:      name,
+				Differences: objectDifferences,
+			})
+		}
+	}
+
+	return report
+}
+
+// Writes whichever reports were asked for
+func writeVerifyReports(report *VerifyReport, reports VerifyReports) error {
+	if reports.JSONPath != "" {
+		if err := writeVerifyJSON(report, reports.JSONPath); err != nil {
+			return err
+		}
+		logger.Info(fmt.Sprintf("Wrote JSON report to '%s'.", reports.JSONPath))
+	}
+
+	if reports.JUnitPath != "" {
+		if err := writeVerifyJUnit(report, reports.JUnitPath); err != nil {
+			return err
+		}
+		logger.Info(fmt.Sprintf("Wrote JUnit report to '%s'.", reports.JUnitPath))
+	}
+	return nil
+}
+
+func writeVerifyJSON(report *VerifyReport, path string) error {
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeReportFile(path, append(content, '\n'))
+}
+
+// One suite per object type, one test case per object
+func writeVerifyJUnit(report *VerifyReport, path string) error {
+	suites := junitTestSuites{Name: fmt.Sprintf("Verify %s against %s", report.Target, report.Source)}
+	timestamp := report.GeneratedAt.Format(time.RFC3339)
+
+	for _, objectType := range reportObjectTypes {
+		suite := junitTestSuite{Name: objectType, Timestamp: timestamp}
+
+		for _, object := range report.Objects {
+			if object.ObjectType != objectType {
+				continue
+			}
+
+			testCase := junitTestCase{Name: object.Object, ClassName: report.Target + "." + objectType}
+			if len(object.Differences) > 0 {
+				var lines []string
+				for _, difference := range object.Differences {
+					lines = append(lines, describeDifference(difference))
+				}
+				testCase.Failure = &junitFailure{
+					Message: fmt.Sprintf("%s '%s' differs in %d place(s)", objectType, object.Object, len(object.Differences)),
+					Type:    "SchemaDifference",
+					Text:    strings.Join(lines, "\n"),
+				}
+				suite.Failures++
+			}
+
+			suite.TestCases = append(suite.TestCases, testCase)
+			suite.Tests++
+		}
+
+		// Skip types neither side has, an empty suite is just noise
+		if suite.Tests == 0 {
+			continue
+		}
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	content, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeReportFile(path, append([]byte(xml.Header), append(content, '\n')...))
+}
+
+// The same wording as the log lines, so reports and logs can be read side by side
+func describeDifference(difference Difference) string {
+	switch difference.Kind {
+	case DifferenceMissing, DifferenceExtra:
+		return fmt.Sprintf("%s %s '%s'", difference.Kind, difference.ObjectType, difference.Object)
+	default:
+		return fmt.Sprintf("%s %s '%s'\n\tExpected: %s\n\tFound:    %s",
+			difference.Kind, difference.ObjectType, difference.Object, difference.Expected, difference.Found)
+	}
+}
+
+func writeReportFile(path string, content []byte) error {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, content, 0644)
+}
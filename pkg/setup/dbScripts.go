@@ -0,0 +1,415 @@
+package setup
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Everything in here turns introspected metadata back into T-SQL that setup.Exec can replay
+
+// Wraps an identifier in brackets, escaping any closing brackets inside of it. Seeding quotes with this too
+func QuoteName(name string) string {
+	return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+}
+
+// Quotes a schema qualified identifier, ie: [audit].[Events]
+func QuoteQualifiedName(schemaName, objectName string) string {
+	return QuoteName(schemaName) + "." + QuoteName(objectName)
+}
+
+// Quotes and comma separates a list of identifiers
+func QuoteNames(names []string) string {
+	var quoted []string
+	for _, name := range names {
+		quoted = append(quoted, QuoteName(name))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// Builds the type portion of a column definition, ie: nvarchar(50), decimal(18,2)
+func scriptColumnType(col ColumnDetails) string {
+	if col.UserTypeName != "" {
+		return QuoteQualifiedName(col.UserTypeSchema, col.UserTypeName)
+	}
+
+	switch strings.ToLower(col.Type) {
+	case "char", "varchar", "nchar", "nvarchar", "binary", "varbinary":
+		if col.MaxLength == -1 {
+			return fmt.Sprintf("%s(max)", col.Type)
+		}
+		return fmt.Sprintf("%s(%d)", col.Type, col.MaxLength)
+
+	case "decimal", "numeric":
+		return fmt.Sprintf("%s(%d,%d)", col.Type, col.Precision, col.Scale)
+
+	case "datetime2", "datetimeoffset", "time":
+		return fmt.Sprintf("%s(%d)", col.Type, col.DateTimePrecision)
+
+	case "timestamp":
+		return "rowversion" // timestamp is the deprecated synonym
+
+	default:
+		return col.Type
+	}
+}
+
+// Builds a single column line for a CREATE TABLE statement
+func scriptColumn(col ColumnDetails) string {
+	// Computed columns carry no type of their own, just the expression
+	if col.IsComputed {
+		definition := fmt.Sprintf("%s AS %s", QuoteName(col.Name), col.ComputedDefinition)
+		if col.IsPersisted {
+			definition += " PERSISTED"
+			// Only a persisted column can say so, and a primary key on one needs it
+			if !col.IsNullable {
+				definition += " NOT NULL"
+			}
+		}
+		return definition
+	}
+
+	parts := []string{QuoteName(col.Name), scriptColumnType(col)}
+	if col.Collation != "" {
+		parts = append(parts, "COLLATE "+col.Collation)
+	}
+	if col.IsIdentity {
+		parts = append(parts, fmt.Sprintf("IDENTITY(%d,%d)", col.IdentitySeed, col.IdentityIncrement))
+	}
+	if col.IsNullable {
+		parts = append(parts, "NULL")
+	} else {
+		parts = append(parts, "NOT NULL")
+	}
+	return strings.Join(parts, " ")
+}
+
+// Builds the CREATE TABLE script for a table. Foreign keys are added in their own phase, once every table and unique
+// index exists, and columns computed from a function wait for the modules, along with a primary key that uses them.
+func scriptTable(table TableDetails) string {
+	var sb strings.Builder
+
+	var lines []string
+	for _, col := range table.Columns {
+		if col.DependsOnFunction {
+			continue
+		}
+		lines = append(lines, "\t"+scriptColumn(col))
+	}
+
+	if len(table.PrimaryKeyColumns) > 0 && !columnsDependOnFunction(table, table.PrimaryKeyColumns) {
+		lines = append(lines, "\t"+scriptPrimaryKey(table))
+	}
+
+	sb.WriteString(fmt.Sprintf("CREATE TABLE %s (\n", QuoteQualifiedName(table.SchemaName, table.TableName)))
+	sb.WriteString(strings.Join(lines, ",\n"))
+	sb.WriteString("\n);\n")
+
+	return sb.String()
+}
+
+// Builds the primary key clause, as it goes in CREATE TABLE or after ALTER TABLE ADD
+func scriptPrimaryKey(table TableDetails) string {
+	constraint := ""
+	if table.PrimaryKeyName != "" {
+		constraint = fmt.Sprintf("CONSTRAINT %s ", QuoteName(table.PrimaryKeyName))
+	}
+	// Spell this out, otherwise a nonclustered key would steal the clustered slot from another index
+	clustering := "NONCLUSTERED"
+	if table.PrimaryKeyClustered {
+		clustering = "CLUSTERED"
+	}
+	return constraint + fmt.Sprintf("PRIMARY KEY %s (%s)", clustering, QuoteNames(table.PrimaryKeyColumns))
+}
+
+// Builds every foreign key on a table that can go on before the modules. Returns "" if there are none
+func scriptForeignKeys(table TableDetails) string {
+	var statements []string
+	for _, key := range table.ForeignKeys {
+		if key.DependsOnFunction {
+			continue
+		}
+		statements = append(statements, scriptForeignKey(table, key))
+	}
+
+	if len(statements) == 0 {
+		return ""
+	}
+	return strings.Join(statements, "\n\n") + "\n"
+}
+
+// Builds the ALTER TABLE statement that adds a (possibly composite) foreign key
+func scriptForeignKey(table TableDetails, key ForeignKeyDetails) string {
+	definition := fmt.Sprintf("FOREIGN KEY (%s) REFERENCES %s (%s)",
+		QuoteNames(key.Columns),
+		QuoteQualifiedName(key.ReferencedSchema, key.ReferencedTable),
+		QuoteNames(key.ReferencedColumns),
+	)
+	if key.OnDelete != "" && key.OnDelete != "NO_ACTION" {
+		definition += " ON DELETE " + strings.ReplaceAll(key.OnDelete, "_", " ")
+	}
+	if key.OnUpdate != "" && key.OnUpdate != "NO_ACTION" {
+		definition += " ON UPDATE " + strings.ReplaceAll(key.OnUpdate, "_", " ")
+	}
+	return scriptCheckedConstraint(table, key.Name, definition, key.IsNotTrusted, key.IsDisabled)
+}
+
+// Builds the ALTER TABLE statement that adds a check constraint
+func scriptCheckConstraint(table TableDetails, constraint ConstraintDetails) string {
+	return scriptCheckedConstraint(table, constraint.Name, "CHECK "+constraint.Definition, constraint.IsNotTrusted, constraint.IsDisabled)
+}
+
+// Adds a foreign key or check the way it was on the source. An untrusted constraint is added WITH NOCHECK, so rows the
+// source let slip past it don't fail the add, and a disabled one is switched off again straight after.
+func scriptCheckedConstraint(table TableDetails, name, definition string, isNotTrusted, isDisabled bool) string {
+	tableName := QuoteQualifiedName(table.SchemaName, table.TableName)
+
+	check := ""
+	if isNotTrusted || isDisabled {
+		check = " WITH NOCHECK"
+	}
+	statement := fmt.Sprintf("ALTER TABLE %s%s ADD CONSTRAINT %s %s;", tableName, check, QuoteName(name), definition)
+	if isDisabled {
+		statement += fmt.Sprintf("\nALTER TABLE %s NOCHECK CONSTRAINT %s;", tableName, QuoteName(name))
+	}
+	return statement
+}
+
+// Builds the CREATE SCHEMA script for a user defined schema
+func scriptSchema(schemaName string) string {
+	return fmt.Sprintf("CREATE SCHEMA %s;\n", QuoteName(schemaName))
+}
+
+// Builds the defaults, checks, unique constraints, and indexes for a table. Returns "" if the table has none.
+// Anything that needs a user defined function is left to scriptFunctionDependents.
+func scriptConstraints(table TableDetails) string {
+	return scriptTableConstraints(table, false)
+}
+
+// Builds what scriptTable, scriptConstraints, and scriptForeignKeys left out because it needs a user defined function:
+// computed columns, then the keys, defaults, checks, and indexes that use a function or sit on one of those columns.
+// Returns "" if there are none
+func scriptFunctionDependents(table TableDetails) string {
+	var statements []string
+	tableName := QuoteQualifiedName(table.SchemaName, table.TableName)
+	for _, col := range table.Columns {
+		if col.DependsOnFunction {
+			statements = append(statements, fmt.Sprintf("ALTER TABLE %s ADD %s;", tableName, scriptColumn(col)))
+		}
+	}
+
+	if len(table.PrimaryKeyColumns) > 0 && columnsDependOnFunction(table, table.PrimaryKeyColumns) {
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s ADD %s;", tableName, scriptPrimaryKey(table)))
+	}
+
+	if constraints := scriptTableConstraints(table, true); constraints != "" {
+		statements = append(statements, strings.TrimSuffix(constraints, "\n"))
+	}
+
+	// Keys pointing at another table's deferred key rely on that table's file running first, which the sort order gives
+	for _, key := range table.ForeignKeys {
+		if key.DependsOnFunction {
+			statements = append(statements, scriptForeignKey(table, key))
+		}
+	}
+
+	if len(statements) == 0 {
+		return ""
+	}
+	return strings.Join(statements, "\n\n") + "\n"
+}
+
+// Builds either the constraints that need a user defined function, or the ones that don't
+func scriptTableConstraints(table TableDetails, dependsOnFunction bool) string {
+	var statements []string
+	tableName := QuoteQualifiedName(table.SchemaName, table.TableName)
+
+	for _, constraint := range table.DefaultConstraints {
+		if constraint.DependsOnFunction != dependsOnFunction {
+			continue
+		}
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s DEFAULT %s FOR %s;",
+			tableName, QuoteName(constraint.Name), constraint.Definition, QuoteName(constraint.Column)))
+	}
+
+	for _, constraint := range table.CheckConstraints {
+		if constraint.DependsOnFunction != dependsOnFunction {
+			continue
+		}
+		statements = append(statements, scriptCheckConstraint(table, constraint))
+	}
+
+	for _, index := range table.Indexes {
+		if indexDependsOnFunction(table, index) != dependsOnFunction {
+			continue
+		}
+		statements = append(statements, scriptIndex(table, index))
+	}
+
+	if len(statements) == 0 {
+		return ""
+	}
+	return strings.Join(statements, "\n\n") + "\n"
+}
+
+// Whether an index sits on a column computed from a user defined function
+func indexDependsOnFunction(table TableDetails, index IndexDetails) bool {
+	var columns []string
+	for _, col := range index.Columns {
+		columns = append(columns, col.Name)
+	}
+	columns = append(columns, index.IncludedColumns...)
+	return columnsDependOnFunction(table, columns)
+}
+
+// Whether any of the named columns is computed from a user defined function
+func columnsDependOnFunction(table TableDetails, columns []string) bool {
+	for _, col := range table.Columns {
+		if col.DependsOnFunction && stringInSlice(col.Name, columns) {
+			return true
+		}
+	}
+	return false
+}
+
+// Builds either the unique constraint or the CREATE INDEX statement for an index
+func scriptIndex(table TableDetails, index IndexDetails) string {
+	tableName := QuoteQualifiedName(table.SchemaName, table.TableName)
+	keyColumns := scriptIndexColumns(index)
+
+	clustering := "NONCLUSTERED"
+	if index.IsClustered {
+		clustering = "CLUSTERED"
+	}
+
+	if index.IsUniqueConstraint {
+		return fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s UNIQUE %s (%s);",
+			tableName, QuoteName(index.Name), clustering, keyColumns)
+	}
+
+	unique := ""
+	if index.IsUnique {
+		unique = "UNIQUE "
+	}
+
+	statement := fmt.Sprintf("CREATE %s%s INDEX %s ON %s (%s)",
+		unique, clustering, QuoteName(index.Name), tableName, keyColumns)
+	if len(index.IncludedColumns) > 0 {
+		statement += fmt.Sprintf(" INCLUDE (%s)", QuoteNames(index.IncludedColumns))
+	}
+	if index.FilterDefinition != "" {
+		statement += " WHERE " + index.FilterDefinition
+	}
+	return statement + ";"
+}
+
+// Lists an index's key columns with their direction, ie: [Name] ASC, [CreatedAt] DESC
+func scriptIndexColumns(index IndexDetails) string {
+	var keyColumns []string
+	for _, col := range index.Columns {
+		direction := "ASC"
+		if col.IsDescending {
+			direction = "DESC"
+		}
+		keyColumns = append(keyColumns, QuoteName(col.Name)+" "+direction)
+	}
+	return strings.Join(keyColumns, ", ")
+}
+
+// Builds the CREATE TYPE script for an alias type or table type
+func scriptType(details TypeDetails) string {
+	typeName := QuoteQualifiedName(details.SchemaName, details.TypeName)
+
+	if !details.IsTableType {
+		nullability := "NOT NULL"
+		if details.BaseType.IsNullable {
+			nullability = "NULL"
+		}
+		return fmt.Sprintf("CREATE TYPE %s FROM %s %s;\n", typeName, scriptColumnType(details.BaseType), nullability)
+	}
+
+	var lines []string
+	for _, col := range details.Columns {
+		lines = append(lines, "\t"+scriptColumn(col))
+	}
+
+	// Keys and indexes can only be declared inline on a table type
+	if len(details.PrimaryKeyColumns) > 0 {
+		clustering := "NONCLUSTERED"
+		if details.PrimaryKeyClustered {
+			clustering = "CLUSTERED"
+		}
+		lines = append(lines, fmt.Sprintf("\tPRIMARY KEY %s (%s)", clustering, QuoteNames(details.PrimaryKeyColumns)))
+	}
+	for _, index := range details.Indexes {
+		clustering := "NONCLUSTERED"
+		if index.IsClustered {
+			clustering = "CLUSTERED"
+		}
+		if index.IsUniqueConstraint {
+			lines = append(lines, fmt.Sprintf("\tUNIQUE %s (%s)", clustering, scriptIndexColumns(index)))
+			continue
+		}
+		unique := ""
+		if index.IsUnique {
+			unique = "UNIQUE "
+		}
+		lines = append(lines, fmt.Sprintf("\tINDEX %s %s%s (%s)", QuoteName(index.Name), unique, clustering, scriptIndexColumns(index)))
+	}
+
+	return fmt.Sprintf("CREATE TYPE %s AS TABLE (\n%s\n);\n", typeName, strings.Join(lines, ",\n"))
+}
+
+// Builds the CREATE SEQUENCE script for a sequence
+func scriptSequence(sequence SequenceDetails) string {
+	parts := []string{
+		fmt.Sprintf("CREATE SEQUENCE %s AS %s", QuoteQualifiedName(sequence.SchemaName, sequence.SequenceName), scriptSequenceType(sequence.DataType)),
+		"START WITH " + sequence.StartValue,
+		"INCREMENT BY " + sequence.Increment,
+		"MINVALUE " + sequence.MinValue,
+		"MAXVALUE " + sequence.MaxValue,
+	}
+
+	if sequence.IsCycling {
+		parts = append(parts, "CYCLE")
+	} else {
+		parts = append(parts, "NO CYCLE")
+	}
+
+	if !sequence.IsCached {
+		parts = append(parts, "NO CACHE")
+	} else if sequence.CacheSize > 0 {
+		parts = append(parts, fmt.Sprintf("CACHE %d", sequence.CacheSize))
+	} else {
+		parts = append(parts, "CACHE")
+	}
+
+	return strings.Join(parts, "\n\t") + ";\n"
+}
+
+// Sequences only allow integer types, or decimal/numeric with a scale of 0
+func scriptSequenceType(dataType ColumnDetails) string {
+	switch strings.ToLower(dataType.Type) {
+	case "decimal", "numeric":
+		return fmt.Sprintf("%s(%d,0)", dataType.Type, dataType.Precision)
+	default:
+		return dataType.Type
+	}
+}
+
+// Builds the CREATE SYNONYM script for a synonym. The base object name comes back already quoted
+func scriptSynonym(synonym SynonymDetails) string {
+	return fmt.Sprintf("CREATE SYNONYM %s FOR %s;\n", QuoteQualifiedName(synonym.SchemaName, synonym.SynonymName), synonym.BaseObjectName)
+}
+
+// Builds the ENABLE or DISABLE TRIGGER statement for a trigger, on its table or view, or the database
+func scriptTriggerState(trigger TriggerDetails, enabled bool) string {
+	parent := "DATABASE"
+	if trigger.SchemaName != "" {
+		parent = QuoteQualifiedName(trigger.SchemaName, trigger.ParentName)
+	}
+	action := "DISABLE"
+	if enabled {
+		action = "ENABLE"
+	}
+	return fmt.Sprintf("%s TRIGGER %s ON %s;", action, quoteTriggerName(trigger), parent)
+}
@@ -2,50 +2,49 @@ package setup
 
 import (
 	"fmt"
-	"os"
-	"os/exec"
-	"time"
+	"path/filepath"
 
 	"github.com/jlammilliman/dbManager/pkg/config"
+	"github.com/jlammilliman/dbManager/pkg/container"
 	"github.com/jlammilliman/dbManager/pkg/logger"
+	"github.com/jlammilliman/dbManager/pkg/readiness"
 	_ "github.com/denisenkom/go-mssqldb"
 )
 
 // ! THIS IS INTENDED FOR A LOCAL DEVELOPMENT ENVIRONMENT ONLY.
 // Be HYPER CAUTIOUS about allowing the code to tickle prod in such a way
 
-func Exec(config *config.Config, forceRefresh bool) {
+// With atomic set, the schema is built in a single transaction, and a database created by this run is dropped again
+// if anything fails. Either way, a failed setup never leaves a half built target behind.
+func Exec(config *config.Config, forceRefresh bool, atomic bool) {
 
 	// Define connection details
 	server := config.TargetDB.Host
 	port := config.TargetDB.Port
-	username := "sa"                	// Default login from SQLserver
-	password := "Test@123"          	// If you modify this you MUST modify it in the dockerfile
+	username := config.Admin.Username	// DB_ADMIN_USERNAME, sa unless configured
+	password := config.Admin.Password	// DB_ADMIN_PASSWORD, also handed to docker as the sa password
 	database := config.TargetDB.Name	// Name of the database it will spin up in the container
 	containerName := config.DockerContainer 
 
-	// User Account for DB access to TargetDB.Name
-	userUsername := config.TargetDB.Username
-	userPassword := config.TargetDB.Password
+	// The target, logged into as the admin
+	adminDB := targetAsAdmin(config)
 
 	// Check to see if we have an active DB Connection w/ given creds
 	// IFF we do, then we don't have to run with the docker shenanigans
-	isDBConnected := isSQLServerContainerReady(server, port, username, password)
+	isDBConnected := readiness.IsServerUp(adminDB)
 	if !isDBConnected {
 		logger.Warning("No active DB connection found. Checking for docker setup...")
 		// Check for docker container
-		containerRunning := isContainerRunning(containerName)
+		containerRunning := container.IsRunning(config)
 		if containerRunning {
 			logger.Info(fmt.Sprintf("Container '%s' is already running.", containerName))
 		} else {
 			logger.Debug(fmt.Sprintf("Container '%s' is not running. Starting it now...", containerName))
 
-			// Run docker compose
-			cmd := exec.Command("docker-compose", "-f", "scripts/local-db-setup/docker-compose.yml", "up", "-d", "--force-recreate")
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			if err := cmd.Run(); err != nil {
+			// Run compose
+			if err := container.Up(config, true); err != nil {
 				logger.Error(fmt.Sprintf("Failed to start the Docker container: %v", err))
+				return
 			}
 			logger.Info("Docker container up.\n")
 		}
@@ -53,22 +52,15 @@ func Exec(config *config.Config, forceRefresh bool) {
 
 	// Wait for the SQL Server container to start up
 	logger.Debug("Starting Database setup...")
-	for !isSQLServerContainerReady(server, port, username, password) {
-		logger.Debug("Waiting for SQL Server to start...")
-		time.Sleep(5 * time.Second)
-	}
-	logger.Info("Connected to SQL Server.")
-
-	// Create the dev database
-	logger.Debug(fmt.Sprintf("Creating %s database...", database))
-	err := createDatabase(server, port, username, password, database, forceRefresh)
-	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to create %s database: %v", database, err))
+	if err := readiness.WaitForServer(config.ReadyTimeout, adminDB); err != nil {
+		logger.Error(err.Error())
+		logger.Message("If SQL Server is just slow to start, raise DB_READY_TIMEOUT.")
 		return
 	}
+	logger.Info("Connected to SQL Server.")
 
 	// Lookup the database schema to setup the local database. If there is none, we die here
-    err = checkDatabaseDirs(database)
+    err := checkDatabaseDirs(database)
     if err != nil {
         logger.Error(fmt.Sprintf("Error verifying local generation schema. Error: %v",err))
         logger.Message("If Schema does not exist, try running with '--generate' or '-g' to create from a source database.")
@@ -79,79 +71,112 @@ func Exec(config *config.Config, forceRefresh bool) {
 
 	/*
 		A proper local Database copy setup is as follows:
+			- All Schemas exist locally
+			- All user-defined Types, Sequences, and Synonyms exist locally
 			- All Tables exist locally
+			- All Indexes, Defaults, and Check constraints exist locally
 			- All Functions exist locally
 			- All Views exist locally
 			- All Procedures exist locally
-			- A user account exists with read/write access to the database
+			- All Triggers exist locally
+			- Every configured app user exists, with its roles and grants
 
 		Where this gets challenging is creating a propogation strategy. To do this, we assume that the generation
-		process creates an in order schema for us to hydrate the database with. 
+		process creates an in order schema for us to hydrate the database with. The manifest written by generation
+		records that order (and a hash of every script), each directory being applied in the order of generatedDirs.
+		Functions, views, and procedures are the exception: they're applied together, in the dependency order
+		recorded in schema.json, since any of them may depend on any other.
 	*/
 
-	baseDir := fmt.Sprintf("/databases/%s", database)
+	baseDir := filepath.Join("databases", database)
 
-	// TABLES
-	logger.Debug("Creating tables...")
-	tableFiles, err := listFiles(fmt.Sprintf("%s/tables", baseDir))
+	// Check the scripts before touching the server, so a bad snapshot doesn't leave an empty database behind
+	setupFiles, err := getSetupFiles(baseDir, forceRefresh)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to load table schema: %v", err))
+		logger.Error(fmt.Sprintf("Failed to load schema: %v", err))
 		return
 	}
 
-	err = executeSQLFiles(server, port, username, password, database, tableFiles)
+	// Create the dev database
+	logger.Debug(fmt.Sprintf("Creating %s database...", database))
+	created, err := createDatabase(server, port, username, password, database, forceRefresh)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to execute init.sql: %v", err))
+		logger.Error(fmt.Sprintf("Failed to create %s database: %v", database, err))
 		return
 	}
 
-	// VIEWS
-	logger.Debug("Creating Views...")
-	viewFiles, err := listFiles(fmt.Sprintf("%s/views", baseDir))
-	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to load view schema: %v", err))
-		return
+	// With atomic set, anything that can't be rolled back (or an empty shell of a database) goes with the database we just made
+	dropIfCreated := func() {
+		if !atomic || !created {
+			return
+		}
+		logger.Warning(fmt.Sprintf("Dropping '%s', it was created by this setup.", database))
+		if err := dropDatabaseOnServer(server, port, username, password, database); err != nil {
+			logger.Error(fmt.Sprintf("Failed to drop %s database: %v", database, err))
+		}
 	}
 
-	err = executeSQLFiles(server, port, username, password, database, viewFiles)
-	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to execute init.sql: %v", err))
+	// A new or restored database can take a moment to come ONLINE
+	if err := readiness.WaitForDatabase(config.ReadyTimeout, adminDB); err != nil {
+		logger.Error(err.Error())
+		dropIfCreated()
 		return
 	}
 
-	// FUNCTIONS
-	logger.Debug("Creating Functions...")
-	functionFiles, err := listFiles(fmt.Sprintf("%s/functions", baseDir))
+	// Anything already applied (and unchanged since) is skipped, so an existing database is brought up to date
+	// rather than rebuilt
+	applied, err := getAppliedScripts(server, port, username, password, database)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to load function schema: %v", err))
+		logger.Error(fmt.Sprintf("Failed to read schema history: %v", err))
+		dropIfCreated()
 		return
 	}
-
-	err = executeSQLFiles(server, port, username, password, database, functionFiles)
+	setupFiles, pending, err := getPendingFiles(baseDir, setupFiles, applied)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to execute init.sql: %v", err))
+		logger.Error(fmt.Sprintf("Failed to check schema history: %v", err))
+		dropIfCreated()
 		return
 	}
-
-	// PROCEDURES
-	logger.Debug("Creating Procedures...")
-	procedureFiles, err := listFiles(fmt.Sprintf("%s/procedures", baseDir))
-	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to load procedure schema: %v", err))
-		return
+	if pending == 0 {
+		logger.Info(fmt.Sprintf("'%s' is up to date with the local generation.", database))
+	} else {
+		logger.Debug(fmt.Sprintf("%d script(s) to apply.", pending))
 	}
 
-	err = executeSQLFiles(server, port, username, password, database, procedureFiles)
-	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to execute init.sql: %v", err))
-		return
+	// Functions, views, and procedures go in together, in dependency order
+	setupFiles = orderModuleFiles(baseDir, setupFiles)
+	phases := setupPhases()
+
+	if atomic {
+		err = executeSQLFilesInTransaction(server, port, username, password, database, baseDir, phases, setupFiles)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Setup failed: %v", err))
+			dropIfCreated()
+			return
+		}
+	} else {
+		for _, dir := range phases {
+			logger.Debug(fmt.Sprintf("Creating %s...", dir))
+			if dir == modulePhase {
+				// Anything the ordering got wrong gets another chance once the rest exists
+				err = executeSQLFilesWithRetry(server, port, username, password, database, baseDir, setupFiles[dir])
+			} else {
+				err = executeSQLFiles(server, port, username, password, database, baseDir, setupFiles[dir])
+			}
+			if err != nil {
+				logger.Error(fmt.Sprintf("Failed to create %s: %v", dir, err))
+				logger.Message("Everything before the failure is recorded in the schema history, and rerunning setup picks up from here. Run with '--atomic' to roll back failed setups instead.")
+				return
+			}
+		}
 	}
 
-	// CREATE USER FOR DATABASE
-	logger.Debug(fmt.Sprintf("Creating read/write user on %s...", database))
-	err = createReadWriteUser(server, port, username, password, database, userUsername, userPassword)
+	// CREATE USERS FOR DATABASE
+	logger.Debug(fmt.Sprintf("Creating %d app user(s) on %s...", len(config.AppUsers), database))
+	err = createAppUsers(server, port, username, password, database, config.AppUsers)
 	if err != nil {
 		logger.Error(fmt.Sprintf("Failed to create user: %v", err))
+		dropIfCreated()
 		return
 	}
 
@@ -0,0 +1,114 @@
+package setup
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/jlammilliman/dbManager/pkg/config"
+	"github.com/jlammilliman/dbManager/pkg/logger"
+)
+
+// App users are the logins applications connect to the target with. Everything here is safe to rerun:
+// existing logins get their password brought in line with the config, and existing users, roles, and grants are left be.
+
+// Creates (or updates) every configured app user on the target, connecting as the admin login
+func createAppUsers(server, port, username, password, database string, users []config.AppUser) error {
+	connString := fmt.Sprintf("server=%s;port=%s;user id=%s;password=%s;database=%s", server, port, username, password, database)
+	db, err := sql.Open("sqlserver", connString)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, user := range users {
+		// The admin already owns everything, and resetting its password here would lock us out
+		if strings.EqualFold(user.Username, username) {
+			logger.Debug(fmt.Sprintf("Skipping app user '%s', it's the admin login.", user.Username))
+			continue
+		}
+
+		if err := createAppUser(db, user); err != nil {
+			return fmt.Errorf("failed to set up '%s': %v", user.Username, err)
+		}
+		logger.Debug(fmt.Sprintf("App user '%s' is ready.", user.Username))
+	}
+	return nil
+}
+
+func createAppUser(db *sql.DB, user config.AppUser) error {
+	// CREATE LOGIN doesn't take parameters, so the password is escaped into the statement.
+	// It only ever travels over the connection, never through a command line.
+	login := QuoteName(user.Username)
+	passwordLiteral := "N'" + escapeString(user.Password) + "'"
+
+	var loginExists bool
+	if err := db.QueryRow("SELECT CAST(CASE WHEN SUSER_ID(@p1) IS NULL THEN 0 ELSE 1 END AS BIT)", user.Username).Scan(&loginExists); err != nil {
+		return err
+	}
+	if loginExists {
+		if _, err := db.Exec(fmt.Sprintf("ALTER LOGIN %s WITH PASSWORD = %s;", login, passwordLiteral)); err != nil {
+			return fmt.Errorf("failed to update login: %v", err)
+		}
+	} else {
+		if _, err := db.Exec(fmt.Sprintf("CREATE LOGIN %s WITH PASSWORD = %s;", login, passwordLiteral)); err != nil {
+			return fmt.Errorf("failed to create login: %v", err)
+		}
+	}
+
+	// The login may already be mapped into the database, possibly under another name
+	var userName sql.NullString
+	err := db.QueryRow("SELECT name FROM sys.database_principals WHERE sid = SUSER_SID(@p1)", user.Username).Scan(&userName)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if !userName.Valid {
+		if _, err := db.Exec(fmt.Sprintf("CREATE USER %s FOR LOGIN %s;", login, login)); err != nil {
+			return fmt.Errorf("failed to create user: %v", err)
+		}
+		userName = sql.NullString{String: user.Username, Valid: true}
+	}
+
+	// The database owner can't be a role member, and doesn't need to be
+	if userName.String == "dbo" {
+		logger.Debug(fmt.Sprintf("'%s' owns the database, skipping its roles and grants.", user.Username))
+		return nil
+	}
+
+	roles := append(append([]string{}, user.Roles...), user.CustomRoles...)
+	for _, role := range roles {
+		var roleExists, isMember bool
+		err := db.QueryRow(`
+		SELECT
+			CAST(CASE WHEN DATABASE_PRINCIPAL_ID(@p1) IS NULL THEN 0 ELSE 1 END AS BIT),
+			CAST(COALESCE(IS_ROLEMEMBER(@p1, @p2), 0) AS BIT)`, role, userName.String).Scan(&roleExists, &isMember)
+		if err != nil {
+			return err
+		}
+
+		// A typo shouldn't quietly turn into a new, empty role. Only the ones marked custom get created
+		if !roleExists && !stringInSlice(role, user.CustomRoles) {
+			return fmt.Errorf("role '%s' doesn't exist on the target. If it's meant to be created, list it under _CUSTOM_ROLES instead", role)
+		}
+		if !roleExists {
+			logger.Debug(fmt.Sprintf("Creating role '%s'...", role))
+			if _, err := db.Exec(fmt.Sprintf("CREATE ROLE %s;", QuoteName(role))); err != nil {
+				return fmt.Errorf("failed to create role '%s': %v", role, err)
+			}
+		}
+		if isMember {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER ROLE %s ADD MEMBER %s;", QuoteName(role), QuoteName(userName.String))); err != nil {
+			return fmt.Errorf("failed to add user to role '%s': %v", role, err)
+		}
+	}
+
+	// Granting something twice is harmless, so these just get reapplied
+	for _, grant := range user.Grants {
+		if _, err := db.Exec(fmt.Sprintf("GRANT %s TO %s;", grant, QuoteName(userName.String))); err != nil {
+			return fmt.Errorf("failed to grant '%s': %v", grant, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+package setup
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	_ "github.com/denisenkom/go-mssqldb"
+	"github.com/jlammilliman/dbManager/pkg/config"
+	"github.com/jlammilliman/dbManager/pkg/logger"
+	"github.com/jlammilliman/dbManager/pkg/readiness"
+)
+
+// Verification compares the schema of the source database (or the snapshot generated from it) against the target,
+// and reports anything that drifted. Objects are compared by the script we would generate for them, so "changed"
+// means "would be scripted differently".
+
+var (
+	DifferenceMissing = "Missing" // Exists on the source, but not on the target
+	DifferenceExtra   = "Extra"   // Exists on the target, but not on the source
+	DifferenceChanged = "Changed" // Exists on both, but doesn't match
+)
+
+type Difference struct {
+	ObjectType string `json:"objectType"`         // Table, Column, PrimaryKey, ForeignKey, Index, Constraint, View, Function, Procedure, Type, Sequence, Synonym, Trigger
+	Object     string `json:"object"`             // Schema qualified, ie: dbo.Users or dbo.Users.email
+	Table      string `json:"table,omitempty"`    // The table a table level difference belongs to
+	Kind       string `json:"kind"`               // DifferenceMissing, DifferenceExtra, or DifferenceChanged
+	Expected   string `json:"expected,omitempty"` // What the source has, if anything
+	Found      string `json:"found,omitempty"`    // What the target has, if anything
+}
+
+// Everything we know how to introspect from a database
+type DatabaseDetails struct {
+	Tables    []TableDetails
+	Modules   []ModuleDetails
+	Types     []TypeDetails
+	Sequences []SequenceDetails
+	Synonyms  []SynonymDetails
+	Triggers  []TriggerDetails
+}
+
+// Verifies the target against the live source, or against the local generation at databases/<target> if fromSnapshot
+// is set (or no source is configured). Findings are always logged, and optionally written to the given reports.
+// Returns true if they match.
+func Verify(config *config.Config, fromSnapshot bool, reports VerifyReports) bool {
+	source, sourceName, err := loadExpectedSchema(config, fromSnapshot)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to read schema from '%s': %v", sourceName, err))
+		return false
+	}
+
+	// The app login can't see module definitions, they'd all come back as missing
+	target, err := introspectDatabase(targetAsAdmin(config))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to read schema from target '%s': %v", config.TargetDB.Name, err))
+		return false
+	}
+
+	differences := compareDatabases(source, target)
+	logDifferences(differences)
+
+	report := buildVerifyReport(sourceName, config.TargetDB.Name, source, target, differences)
+	if err := writeVerifyReports(report, reports); err != nil {
+		logger.Error(fmt.Sprintf("Failed to write verification report: %v", err))
+		return false
+	}
+
+	if len(differences) > 0 {
+		logger.Error(fmt.Sprintf("'%s' differs from '%s' in %d place(s).", config.TargetDB.Name, sourceName, len(differences)))
+		return false
+	}
+	logger.Info(fmt.Sprintf("'%s' matches '%s'.", config.TargetDB.Name, sourceName))
+	return true
+}
+
+// Loads the schema the target is supposed to have: the live source, or the snapshot at databases/<target> if
+// fromSnapshot is set (or no source is configured). Also returns a name for wherever it came from
+func loadExpectedSchema(config *config.Config, fromSnapshot bool) (*DatabaseDetails, string, error) {
+	if fromSnapshot || !config.HasSource {
+		baseDir := filepath.Join("databases", config.TargetDB.Name)
+		logger.Debug(fmt.Sprintf("Using the snapshot at '%s'.", baseDir))
+
+		source, err := readSchemaSnapshot(baseDir)
+		if os.IsNotExist(err) {
+			logger.Message("Snapshots generated before schema.json existed need to be regenerated with '--generate' or '-g'.")
+			return nil, baseDir, fmt.Errorf("no %s found", schemaFileName)
+		}
+		return source, baseDir, err
+	}
+
+	source, err := introspectDatabase(config.SourceDB)
+	return source, config.SourceDB.Name, err
+}
+
+// Pulls the full schema of a database, using the same lookups generation does
+func introspectDatabase(database config.DB) (*DatabaseDetails, error) {
+	db, err := openDatabase(database)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	details := &DatabaseDetails{}
+	if details.Tables, err = getTables(db, database.Name); err != nil {
+		return nil, err
+	}
+	if details.Modules, err = getSchema(db, database.Name); err != nil {
+		return nil, err
+	}
+	if details.Types, err = getTypes(db); err != nil {
+		return nil, err
+	}
+	if details.Sequences, err = getSequences(db); err != nil {
+		return nil, err
+	}
+	if details.Synonyms, err = getSynonyms(db); err != nil {
+		return nil, err
+	}
+	if details.Triggers, err = getTriggers(db); err != nil {
+		return nil, err
+	}
+	return details, nil
+}
+
+// Connects to a configured database, failing early if the server isn't up
+func openDatabase(database config.DB) (*sql.DB, error) {
+	if !readiness.IsServerUp(database) {
+		return nil, fmt.Errorf("no active DB connection found at '%s:%s'", database.Host, database.Port)
+	}
+
+	connString := fmt.Sprintf("server=%s;port=%s;user id=%s;password=%s;database=%s", database.Host, database.Port, database.Username, database.Password, database.Name)
+	return sql.Open("sqlserver", connString)
+}
+
+func logDifferences(differences []Difference) {
+	for _, difference := range differences {
+		logger.Warning(describeDifference(difference))
+	}
+}
+
+// Compares two sets of named definitions, reporting what is missing, extra, or changed in target
+func compareDefinitions(objectType string, source, target map[string]string) []Difference {
+	var differences []Difference
+
+	var names []string
+	for name := range source {
+		names = append(names, name)
+	}
+	for name := range target {
+		if _, exists := source[name]; !exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		expected, inSource := source[name]
+		found, inTarget := target[name]
+		switch {
+		case !inTarget:
+			differences = append(differences, Difference{ObjectType: objectType, Object: name, Kind: DifferenceMissing, Expected: expected})
+		case !inSource:
+			differences = append(differences, Difference{ObjectType: objectType, Object: name, Kind: DifferenceExtra, Found: found})
+		case expected != found:
+			differences = append(differences, Difference{ObjectType: objectType, Object: name, Kind: DifferenceChanged, Expected: expected, Found: found})
+		}
+	}
+	return differences
+}
+
+// Collapses whitespace so formatting alone never counts as a change
+func normalizeDefinition(definition string) string {
+	return strings.Join(strings.Fields(definition), " ")
+}
+
+func compareDatabases(source, target *DatabaseDetails) []Difference {
+	var differences []Difference
+
+	differences = append(differences, compareTables(source.Tables, target.Tables)...)
+	differences = append(differences, compareDefinitions("Type", typeDefinitions(source.Types), typeDefinitions(target.Types))...)
+	differences = append(differences, compareDefinitions("Sequence", sequenceDefinitions(source.Sequences), sequenceDefinitions(target.Sequences))...)
+	differences = append(differences, compareDefinitions("Synonym", synonymDefinitions(source.Synonyms), synonymDefinitions(target.Synonyms))...)
+
+	for _, objectType := range []string{"Function", "View", "Procedure"} {
+		differences = append(differences, compareDefinitions(objectType,
+			moduleDefinitions(source.Modules, objectType), moduleDefinitions(target.Modules, objectType))...)
+	}
+
+	differences = append(differences, compareDefinitions("Trigger", triggerDefinitions(source.Triggers), triggerDefinitions(target.Triggers))...)
+	return differences
+}
+
+// Tables only count as missing or extra as a whole. Tables on both sides are compared piece by piece
+func compareTables(source, target []TableDetails) []Difference {
+	sourceTables := tablesByName(source)
+	targetTables := tablesByName(target)
+
+	sourceNames := make(map[string]string)
+	for name := range sourceTables {
+		sourceNames[name] = name
+	}
+	targetNames := make(map[string]string)
+	for name := range targetTables {
+		targetNames[name] = name
+	}
+
+	var differences []Difference
+	for _, difference := range compareDefinitions("Table", sourceNames, targetNames) {
+		// Names always match, so anything reported here is missing or extra
+		difference.Expected, difference.Found = "", ""
+		difference.Table = difference.Object
+		differences = append(differences, difference)
+	}
+
+	var names []string
+	for name := range sourceTables {
+		if _, exists := targetTables[name]; exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		sourceTable, targetTable := sourceTables[name], targetTables[name]
+
+		var tableDifferences []Difference
+		tableDifferences = append(tableDifferences, compareDefinitions("Column", columnDefinitions(sourceTable), columnDefinitions(targetTable))...)
+		tableDifferences = append(tableDifferences, compareDefinitions("PrimaryKey", primaryKeyDefinitions(sourceTable), primaryKeyDefinitions(targetTable))...)
+		tableDifferences = append(tableDifferences, compareDefinitions("ForeignKey", foreignKeyDefinitions(sourceTable), foreignKeyDefinitions(targetTable))...)
+		tableDifferences = append(tableDifferences, compareDefinitions("Index", indexDefinitions(sourceTable), indexDefinitions(targetTable))...)
+		tableDifferences = append(tableDifferences, compareDefinitions("Constraint", constraintDefinitions(sourceTable), constraintDefinitions(targetTable))...)
+
+		for _, difference := range tableDifferences {
+			difference.Table = name
+			differences = append(differences, difference)
+		}
+	}
+	return differences
+}
+
+func tablesByName(tables []TableDetails) map[string]TableDetails {
+	byName := make(map[string]TableDetails)
+	for _, table := range tables {
+		byName[qualifiedName(table.SchemaName, table.TableName)] = table
+	}
+	return byName
+}
+
+// The following turn each kind of object into "qualified name" -> "how we would script it"
+
+func columnDefinitions(table TableDetails) map[string]string {
+	definitions := make(map[string]string)
+	for _, col := range table.Columns {
+		definitions[qualifiedName(qualifiedName(table.SchemaName, table.TableName), col.Name)] = scriptColumn(col)
+	}
+	return definitions
+}
+
+// Primary key names are frequently system generated, so only the shape of the key is compared
+func primaryKeyDefinitions(table TableDetails) map[string]string {
+	definitions := make(map[string]string)
+	if len(table.PrimaryKeyColumns) > 0 {
+		clustering := "NONCLUSTERED"
+		if table.PrimaryKeyClustered {
+			clustering = "CLUSTERED"
+		}
+		definitions[qualifiedName(table.SchemaName, table.TableName)] = fmt.Sprintf("PRIMARY KEY %s (%s)", clustering, QuoteNames(table.PrimaryKeyColumns))
+	}
+	return definitions
+}
+
+func foreignKeyDefinitions(table TableDetails) map[string]string {
+	definitions := make(map[string]string)
+	for _, key := range table.ForeignKeys {
+		definitions[qualifiedName(qualifiedName(table.SchemaName, table.TableName), key.Name)] = scriptForeignKey(table, key)
+	}
+	return definitions
+}
+
+func indexDefinitions(table TableDetails) map[string]string {
+	definitions := make(map[string]string)
+	for _, index := range table.Indexes {
+		definitions[qualifiedName(qualifiedName(table.SchemaName, table.TableName), index.Name)] = scriptIndex(table, index)
+	}
+	return definitions
+}
+
+// Defaults are keyed by column, since their names are frequently system generated. Checks are keyed by name
+func constraintDefinitions(table TableDetails) map[string]string {
+	definitions := make(map[string]string)
+	tableName := qualifiedName(table.SchemaName, table.TableName)
+	for _, constraint := range table.DefaultConstraints {
+		definitions[qualifiedName(tableName, constraint.Column)+" (default)"] = "DEFAULT " + constraint.Definition
+	}
+	for _, constraint := range table.CheckConstraints {
+		definitions[qualifiedName(tableName, constraint.Name)] = scriptCheckConstraint(table, constraint)
+	}
+	return definitions
+}
+
+func moduleDefinitions(modules []ModuleDetails, objectType string) map[string]string {
+	definitions := make(map[string]string)
+	for _, module := range modules {
+		if module.ObjectType == objectType {
+			definitions[qualifiedName(module.SchemaName, module.ObjectName)] = normalizeDefinition(module.Definition)
+		}
+	}
+	return definitions
+}
+
+func typeDefinitions(types []TypeDetails) map[string]string {
+	definitions := make(map[string]string)
+	for _, details := range types {
+		definitions[qualifiedName(details.SchemaName, details.TypeName)] = normalizeDefinition(scriptType(details))
+	}
+	return definitions
+}
+
+func sequenceDefinitions(sequences []SequenceDetails) map[string]string {
+	definitions := make(map[string]string)
+	for _, sequence := range sequences {
+		definitions[qualifiedName(sequence.SchemaName, sequence.SequenceName)] = normalizeDefinition(scriptSequence(sequence))
+	}
+	return definitions
+}
+
+func synonymDefinitions(synonyms []SynonymDetails) map[string]string {
+	definitions := make(map[string]string)
+	for _, synonym := range synonyms {
+		definitions[qualifiedName(synonym.SchemaName, synonym.SynonymName)] = normalizeDefinition(scriptSynonym(synonym))
+	}
+	return definitions
+}
+
+func triggerDefinitions(triggers []TriggerDetails) map[string]string {
+	definitions := make(map[string]string)
+	for _, trigger := range triggers {
+		name := trigger.TriggerName
+		if trigger.SchemaName != "" {
+			name = qualifiedName(trigger.SchemaName, trigger.TriggerName)
+		}
+		definition := normalizeDefinition(trigger.Definition)
+		if trigger.IsDisabled {
+			definition += " (disabled)"
+		}
+		definitions[name] = definition
+	}
+	return definitions
+}
@@ -0,0 +1,145 @@
+package setup
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jlammilliman/dbManager/pkg/config"
+	"github.com/jlammilliman/dbManager/pkg/logger"
+)
+
+// Data verification compares what is in each table, rather than how the table is shaped.
+// Every table gets a row count and a fingerprint: each row is serialized with FOR XML, hashed with HASHBYTES,
+// and the hashes are rolled up with CHECKSUM_AGG. Row order doesn't matter, row contents do.
+
+type TableFingerprint struct {
+	RowCount int64
+	Checksum sql.NullInt64 // NULL for an empty table
+}
+
+// Compares row counts and fingerprints of every table on the source against the target.
+// Data only lives on a live source, so there is no snapshot mode. Returns true if every table matches.
+func VerifyData(config *config.Config) bool {
+	if !config.HasSource {
+		logger.Error("Cannot verify data without a provided source DB!")
+		return false
+	}
+
+	sourceDB, err := openDatabase(config.SourceDB)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to connect to source '%s': %v", config.SourceDB.Name, err))
+		return false
+	}
+	defer sourceDB.Close()
+
+	targetDB, err := openDatabase(config.TargetDB)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to connect to target '%s': %v", config.TargetDB.Name, err))
+		return false
+	}
+	defer targetDB.Close()
+
+	sourceTables, err := getTables(sourceDB, config.SourceDB.Name)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to get tables from source '%s': %v", config.SourceDB.Name, err))
+		return false
+	}
+	targetTables, err := getTables(targetDB, config.TargetDB.Name)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to get tables from target '%s': %v", config.TargetDB.Name, err))
+		return false
+	}
+	targetByName := tablesByName(targetTables)
+
+	sort.Slice(sourceTables, func(i, j int) bool {
+		return qualifiedName(sourceTables[i].SchemaName, sourceTables[i].TableName) < qualifiedName(sourceTables[j].SchemaName, sourceTables[j].TableName)
+	})
+
+	var mismatched []string
+	for _, table := range sourceTables {
+		name := qualifiedName(table.SchemaName, table.TableName)
+
+		targetTable, exists := targetByName[name]
+		if !exists {
+			logger.Warning(fmt.Sprintf("Table '%s' is missing from the target.", name))
+			mismatched = append(mismatched, name)
+			continue
+		}
+
+		// Only columns both sides have can be fingerprinted the same way
+		columns := fingerprintColumns(table, targetTable)
+		if len(columns) != len(fingerprintColumns(table, table)) {
+			logger.Warning(fmt.Sprintf("Table '%s' has different columns on the target, only the shared columns are compared.", name))
+		}
+
+		expected, err := getTableFingerprint(sourceDB, table, columns)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to fingerprint '%s' on source: %v", name, err))
+			return false
+		}
+		found, err := getTableFingerprint(targetDB, targetTable, columns)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to fingerprint '%s' on target: %v", name, err))
+			return false
+		}
+
+		switch {
+		case expected.RowCount != found.RowCount:
+			logger.Warning(fmt.Sprintf("Table '%s' has %d row(s) on the source, %d on the target.", name, expected.RowCount, found.RowCount))
+			mismatched = append(mismatched, name)
+		case expected.Checksum != found.Checksum:
+			logger.Warning(fmt.Sprintf("Table '%s' has %d row(s) on both, but their contents differ.", name, expected.RowCount))
+			mismatched = append(mismatched, name)
+		default:
+			logger.Debug(fmt.Sprintf("Table '%s' matches (%d rows).", name, expected.RowCount))
+		}
+	}
+
+	if len(mismatched) > 0 {
+		logger.Error(fmt.Sprintf("%d of %d table(s) differ between '%s' and '%s': %s",
+			len(mismatched), len(sourceTables), config.SourceDB.Name, config.TargetDB.Name, strings.Join(mismatched, ", ")))
+		return false
+	}
+	logger.Info(fmt.Sprintf("All %d table(s) in '%s' match '%s'.", len(sourceTables), config.TargetDB.Name, config.SourceDB.Name))
+	return true
+}
+
+// The columns that go into a fingerprint, in source order. Rowversions are unique per database, so they never match
+func fingerprintColumns(source, target TableDetails) []string {
+	var columns []string
+	for _, col := range source.Columns {
+		if col.IsRowVersion {
+			continue
+		}
+		if columnInTable(col.Name, target) {
+			columns = append(columns, col.Name)
+		}
+	}
+	return columns
+}
+
+// Counts the rows of a table and fingerprints their contents
+func getTableFingerprint(db *sql.DB, table TableDetails, columns []string) (TableFingerprint, error) {
+	var selected []string
+	for _, col := range columns {
+		selected = append(selected, "t."+QuoteName(col))
+	}
+
+	tableName := QuoteQualifiedName(table.SchemaName, table.TableName)
+
+	// Without any columns to hash, the row count is all we have
+	query := fmt.Sprintf("SELECT COUNT_BIG(*), CAST(NULL AS BIGINT) FROM %s AS t", tableName)
+	if len(selected) > 0 {
+		// Each row is hashed on its own first, an aggregate can't take a subquery. The hashes are summed rather than
+		// run through CHECKSUM_AGG, which XORs them, so duplicate rows would cancel each other out
+		query = fmt.Sprintf(`SELECT COUNT_BIG(*), SUM(CAST(CHECKSUM(r.hash) AS BIGINT))
+		FROM %s AS t
+		CROSS APPLY (SELECT HASHBYTES('SHA2_256', (SELECT %s FOR XML RAW, BINARY BASE64)) AS hash) AS r`, tableName, strings.Join(selected, ", "))
+	}
+
+	var fingerprint TableFingerprint
+	err := db.QueryRow(query).Scan(&fingerprint.RowCount, &fingerprint.Checksum)
+	return fingerprint, err
+}
@@ -0,0 +1,361 @@
+package setup
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jlammilliman/dbManager/pkg/config"
+	"github.com/jlammilliman/dbManager/pkg/logger"
+)
+
+// Versioned migrations live in databases/<target>/migrations as V###__description.up.sql, with a matching .down.sql
+// that undoes it. They let a local schema evolve in small steps instead of being recloned from source.
+// The versions applied to a target are tracked in their own table, next to the schema history.
+
+var migrationsDirName = "migrations"
+
+var VersionTableName = "__SchemaVersions"
+
+var migrationFilePattern = regexp.MustCompile(`^V(\d+)__(.+)\.(up|down)\.sql$`)
+
+// Anything that isn't a lowercase letter or digit becomes an underscore in a migration's file name
+var migrationSlugPattern = regexp.MustCompile(`[^a-z0-9]+`)
+
+type VersionedMigration struct {
+	Version     int
+	Description string
+	UpPath      string
+	DownPath    string // Empty if there's no way back
+}
+
+// Reads every migration in a directory, ordered by version
+func getVersionedMigrations(dir string) ([]VersionedMigration, error) {
+	files, err := listFiles(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*VersionedMigration)
+	for _, file := range files {
+		match := migrationFilePattern.FindStringSubmatch(filepath.Base(file))
+		if match == nil {
+			logger.Warning(fmt.Sprintf("'%s' isn't named V###__description.up.sql or .down.sql, skipping it.", file))
+			continue
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid version in '%s': %v", file, err)
+		}
+
+		migration, exists := byVersion[version]
+		if !exists {
+			migration = &VersionedMigration{Version: version, Description: match[2]}
+			byVersion[version] = migration
+		} else if migration.Description != match[2] {
+			return nil, fmt.Errorf("version %d is used by more than one migration ('%s' and '%s')", version, migration.Description, match[2])
+		}
+
+		if match[3] == "up" {
+			migration.UpPath = file
+		} else {
+			migration.DownPath = file
+		}
+	}
+
+	var migrations []VersionedMigration
+	for _, migration := range byVersion {
+		if migration.UpPath == "" {
+			return nil, fmt.Errorf("version %d (%s) has a .down.sql but no .up.sql", migration.Version, migration.Description)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Creates the version table if it isn't there yet
+func ensureVersionTable(executor sqlExecutor) error {
+	query := fmt.Sprintf(`
+	IF OBJECT_ID(N'%s', N'U') IS NULL
+	CREATE TABLE %s (
+		[Version] INT NOT NULL PRIMARY KEY,
+		[Description] NVARCHAR(400) NOT NULL,
+		[AppliedAt] DATETIME2 NOT NULL DEFAULT SYSUTCDATETIME()
+	);`, escapeString(QuoteQualifiedName(HistorySchemaName, VersionTableName)), QuoteQualifiedName(HistorySchemaName, VersionTableName))
+
+	_, err := executor.ExecContext(context.Background(), query)
+	return err
+}
+
+// Looks up which versions are applied to a target
+func getAppliedVersions(conn *sql.Conn) (map[int]bool, error) {
+	rows, err := conn.QueryContext(context.Background(), fmt.Sprintf("SELECT [Version] FROM %s", QuoteQualifiedName(HistorySchemaName, VersionTableName)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// Brings the target to the given version, applying or rolling back migrations as needed. A negative version means latest.
+// Returns false if anything went wrong.
+func MigrateToVersion(config *config.Config, version int) bool {
+	return runVersionedMigrations(config, func(migrations []VersionedMigration, applied map[int]bool) ([]VersionedMigration, []VersionedMigration, error) {
+		if version < 0 && len(migrations) > 0 {
+			version = migrations[len(migrations)-1].Version
+		}
+
+		found := version == 0 // 0 is "before any migration"
+		var ups, downs []VersionedMigration
+		for _, migration := range migrations {
+			if migration.Version == version {
+				found = true
+			}
+			if migration.Version <= version && !applied[migration.Version] {
+				ups = append(ups, migration)
+			}
+		}
+		if !found && len(migrations) > 0 {
+			return nil, nil, fmt.Errorf("there is no migration for version %d", version)
+		}
+
+		onDisk := migrationsByVersion(migrations)
+		for _, appliedVersion := range sortedVersions(applied) {
+			if appliedVersion <= version {
+				break
+			}
+			migration, exists := onDisk[appliedVersion]
+			if !exists {
+				return nil, nil, fmt.Errorf("V%03d is applied but has no files on disk, so it can't be rolled back to get to version %d", appliedVersion, version)
+			}
+			downs = append(downs, migration)
+		}
+		return ups, downs, nil
+	})
+}
+
+// Rolls back the last steps migrations applied to the target. Returns false if anything went wrong.
+func RollbackVersions(config *config.Config, steps int) bool {
+	return runVersionedMigrations(config, func(migrations []VersionedMigration, applied map[int]bool) ([]VersionedMigration, []VersionedMigration, error) {
+		var downs []VersionedMigration
+		onDisk := migrationsByVersion(migrations)
+		for _, version := range sortedVersions(applied) {
+			if len(downs) == steps {
+				break
+			}
+			migration, exists := onDisk[version]
+			if !exists {
+				return nil, nil, fmt.Errorf("V%03d is applied but has no files on disk, so it can't be rolled back", version)
+			}
+			downs = append(downs, migration)
+		}
+		if len(downs) < steps {
+			logger.Warning(fmt.Sprintf("Only %d migration(s) are applied, rolling back all of them.", len(downs)))
+		}
+		return nil, downs, nil
+	})
+}
+
+// Works out which migrations to apply (in order) and roll back (in order) given what's on disk and what's applied
+type versionPlanner func(migrations []VersionedMigration, applied map[int]bool) ([]VersionedMigration, []VersionedMigration, error)
+
+func runVersionedMigrations(config *config.Config, plan versionPlanner) bool {
+	baseDir := filepath.Join("databases", config.TargetDB.Name)
+	migrations, err := getVersionedMigrations(filepath.Join(baseDir, migrationsDirName))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to read migrations: %v", err))
+		return false
+	}
+
+	db, err := openDatabase(targetAsAdmin(config))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to connect to target '%s': %v", config.TargetDB.Name, err))
+		return false
+	}
+	defer db.Close()
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to connect to target '%s': %v", config.TargetDB.Name, err))
+		return false
+	}
+	defer conn.Close()
+
+	if err := ensureHistoryTable(conn); err != nil {
+		logger.Error(fmt.Sprintf("Failed to create schema history: %v", err))
+		return false
+	}
+	if err := ensureVersionTable(conn); err != nil {
+		logger.Error(fmt.Sprintf("Failed to create version table: %v", err))
+		return false
+	}
+
+	applied, err := getAppliedVersions(conn)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to read applied versions: %v", err))
+		return false
+	}
+
+	// Someone deleted or renamed a migration after it was applied
+	onDisk := migrationsByVersion(migrations)
+	for _, version := range sortedVersions(applied) {
+		if _, exists := onDisk[version]; !exists {
+			logger.Warning(fmt.Sprintf("V%03d is applied to '%s', but has no files in '%s'.", version, config.TargetDB.Name, filepath.Join(baseDir, migrationsDirName)))
+		}
+	}
+
+	ups, downs, err := plan(migrations, applied)
+	if err != nil {
+		logger.Error(err.Error())
+		return false
+	}
+
+	// Check every step can be run before running any of them, so a missing .down.sql doesn't strand the target halfway
+	for _, migration := range downs {
+		if migration.DownPath == "" {
+			logger.Error(fmt.Sprintf("V%03d (%s) has no .down.sql, it can't be rolled back.", migration.Version, migration.Description))
+			return false
+		}
+	}
+	if len(ups) == 0 && len(downs) == 0 {
+		logger.Info(fmt.Sprintf("'%s' is already at version %d.", config.TargetDB.Name, currentVersion(applied)))
+		return true
+	}
+
+	// Without XACT_ABORT some errors only fail the statement, and the transaction would carry on
+	if _, err := conn.ExecContext(context.Background(), "SET XACT_ABORT ON;"); err != nil {
+		logger.Error(fmt.Sprintf("Failed to prepare session: %v", err))
+		return false
+	}
+
+	for _, migration := range downs {
+		logger.Debug(fmt.Sprintf("Rolling back V%03d (%s)...", migration.Version, migration.Description))
+		err := runVersionStep(conn, baseDir, migration.DownPath, fmt.Sprintf("DELETE FROM %s WHERE [Version] = @p1;",
+			QuoteQualifiedName(HistorySchemaName, VersionTableName)), migration.Version)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to roll back V%03d (%s): %v", migration.Version, migration.Description, err))
+			return false
+		}
+		delete(applied, migration.Version)
+	}
+
+	for _, migration := range ups {
+		logger.Debug(fmt.Sprintf("Applying V%03d (%s)...", migration.Version, migration.Description))
+		err := runVersionStep(conn, baseDir, migration.UpPath, fmt.Sprintf("INSERT INTO %s ([Version], [Description]) VALUES (@p1, @p2);",
+			QuoteQualifiedName(HistorySchemaName, VersionTableName)), migration.Version, migration.Description)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to apply V%03d (%s): %v", migration.Version, migration.Description, err))
+			return false
+		}
+		applied[migration.Version] = true
+	}
+
+	logger.Info(fmt.Sprintf("'%s' is now at version %d.", config.TargetDB.Name, currentVersion(applied)))
+	return true
+}
+
+// Runs a single up or down script along with its change to the version table, all or nothing
+func runVersionStep(conn *sql.Conn, baseDir, file, versionQuery string, args ...interface{}) error {
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %v", err)
+	}
+
+	if err := applyScript(tx, baseDir, file); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(context.Background(), versionQuery, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrationsByVersion(migrations []VersionedMigration) map[int]VersionedMigration {
+	byVersion := make(map[int]VersionedMigration)
+	for _, migration := range migrations {
+		byVersion[migration.Version] = migration
+	}
+	return byVersion
+}
+
+// The applied versions, newest first
+func sortedVersions(applied map[int]bool) []int {
+	var versions []int
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+	return versions
+}
+
+func currentVersion(applied map[int]bool) int {
+	current := 0
+	for version := range applied {
+		if version > current {
+			current = version
+		}
+	}
+	return current
+}
+
+// Lays out the next version's up and down scripts for someone to fill in
+func NewVersionedMigration(config *config.Config, description string) bool {
+	dir := filepath.Join("databases", config.TargetDB.Name, migrationsDirName)
+	migrations, err := getVersionedMigrations(dir)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to read migrations: %v", err))
+		return false
+	}
+
+	version := 1
+	if len(migrations) > 0 {
+		version = migrations[len(migrations)-1].Version + 1
+	}
+
+	slug := strings.Trim(migrationSlugPattern.ReplaceAllString(strings.ToLower(description), "_"), "_")
+	if slug == "" {
+		logger.Error("A migration needs a description, ie: --new-migration \"add user email\"")
+		return false
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logger.Error(fmt.Sprintf("Failed to create '%s': %v", dir, err))
+		return false
+	}
+
+	name := fmt.Sprintf("V%03d__%s", version, slug)
+	scripts := map[string]string{
+		name + ".up.sql":   fmt.Sprintf("-- V%03d: %s\n-- Applied by '--migrate-up'. Separate batches with GO.\n\n", version, description),
+		name + ".down.sql": fmt.Sprintf("-- V%03d: %s\n-- Undoes the .up.sql, applied by '--rollback'.\n\n", version, description),
+	}
+	for fileName, content := range scripts {
+		if err := writeSQLFile(filepath.Join(dir, fileName), content); err != nil {
+			logger.Error(fmt.Sprintf("Failed to write '%s': %v", fileName, err))
+			return false
+		}
+	}
+
+	logger.Info(fmt.Sprintf("Created '%s' (.up.sql and .down.sql) in '%s'.", name, dir))
+	return true
+}